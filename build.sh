@@ -8,4 +8,6 @@ mkdir -p reports/
 go build -o build/echo_client examples/echo_client/*.go
 go build -o build/echo_server examples/echo_server/*.go
 go build -o build/send_client examples/send_client/*.go
-go build -o build/chat examples/chat/*.go
\ No newline at end of file
+go build -o build/chat examples/chat/*.go
+go build -o build/tls_echo examples/tls_echo/*.go
+go build -o build/http_echo examples/http_echo/*.go
@@ -0,0 +1,188 @@
+package wsoding
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const defaultCloseTimeout = 5 * time.Second
+
+// https://datatracker.ietf.org/doc/html/rfc6455#section-7.4.1
+type WSCloseCode uint16
+
+const (
+	CloseNormalClosure      WSCloseCode = 1000
+	CloseGoingAway          WSCloseCode = 1001
+	CloseProtocolError      WSCloseCode = 1002
+	CloseUnsupportedData    WSCloseCode = 1003
+	CloseNoStatusReceived   WSCloseCode = 1005 // Never sent, reported when the peer's CLOSE has no payload
+	CloseAbnormalClosure    WSCloseCode = 1006 // Never sent
+	CloseInvalidPayload     WSCloseCode = 1007
+	ClosePolicyViolation    WSCloseCode = 1008
+	CloseMessageTooBig      WSCloseCode = 1009
+	CloseMandatoryExtension WSCloseCode = 1010
+	CloseInternalError      WSCloseCode = 1011
+	CloseServiceRestart     WSCloseCode = 1012
+	CloseTryAgainLater      WSCloseCode = 1013
+	CloseBadGateway         WSCloseCode = 1014
+	CloseTLSHandshake       WSCloseCode = 1015 // Never sent
+)
+
+// RFC 6455 - Section 7.4.2:
+// > 0-999     Status codes in the range 0-999 are not used.
+// > 1000-2999 Status codes in the range 1000-2999 are reserved for definition by
+// >           this protocol, its future revisions, and extensions specified in a
+// >           permanent and readily available public specification.
+// > 3000-3999 Status codes in the range 3000-3999 are reserved for use by
+// >           libraries, frameworks, and applications.
+// > 4000-4999 Status codes in the range 4000-4999 are reserved for private use
+// >           and thus can't be registered.
+func (code WSCloseCode) isValid() bool {
+	switch {
+	case CloseNormalClosure <= code && code <= CloseUnsupportedData:
+		return true
+	case CloseInvalidPayload <= code && code <= CloseBadGateway:
+		return true
+	case 3000 <= code && code <= 4999:
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseError is returned when the peer has closed the connection with a CLOSE frame
+type CloseError struct {
+	Code   WSCloseCode
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("close frame received: %d %s", e.Code, e.Reason)
+	}
+	return fmt.Sprintf("close frame received: %d", e.Code)
+}
+
+// Is keeps errors.Is(err, ErrCloseFrameSent) working for the code that checked for it before CloseError existed
+func (e *CloseError) Is(target error) bool {
+	return target == ErrCloseFrameSent
+}
+
+// RFC 6455 - Section 5.5.1:
+// > If there is a body, the first two bytes of the body MUST be a 2-byte
+// > unsigned integer (in network byte order) representing a status code
+// > with value /code/ defined in Section 7.4.  Following the 2-byte
+// > integer, the body MAY contain UTF-8-encoded data with value /reason/
+func parseClosePayload(payload []byte) (*CloseError, WSCloseCode, error) {
+	if len(payload) == 0 {
+		return &CloseError{Code: CloseNoStatusReceived}, 0, nil
+	}
+	if len(payload) < 2 {
+		return nil, CloseProtocolError, ErrBadClosePayload
+	}
+	code := WSCloseCode(binary.BigEndian.Uint16(payload))
+	if !code.isValid() {
+		return nil, CloseProtocolError, ErrBadCloseCode
+	}
+	if err := verifyUtf8(payload[2:]); err != nil {
+		return nil, CloseInvalidPayload, err
+	}
+	return &CloseError{Code: code, Reason: string(payload[2:])}, 0, nil
+}
+
+func (ws *WS) sendClose(code WSCloseCode, reason string) error {
+	var payload []byte
+	if code != CloseNoStatusReceived {
+		payload = binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(reason)), uint16(code))
+		payload = append(payload, reason...)
+	}
+	return ws.SendFrame(true, OpCodeCLOSE, payload)
+}
+
+// failConnection sends CLOSE with the code describing the failure, unless it has been sent already, and returns err.
+// The socket is left for the caller to close.
+// https://datatracker.ietf.org/doc/html/rfc6455#section-7.1.7
+func (ws *WS) failConnection(code WSCloseCode, err error) error {
+	if sendErr := ws.sendClose(code, ""); sendErr != nil && !errors.Is(sendErr, ErrCloseSent) {
+		return errors.Join(err, sendErr)
+	}
+	return err
+}
+
+// failReading fails the connection in the middle of a message. Whatever follows cannot be parsed anymore,
+// so every later read returns the same error.
+func (ws *WS) failReading(code WSCloseCode, err error) error {
+	ws.readErr = ws.failConnection(code, err)
+	return ws.readErr
+}
+
+// receiveClose handles the CLOSE frame of the peer.
+// RFC 6455 - Section 5.5.1:
+// > If an endpoint receives a Close frame and did not previously send a
+// > Close frame, the endpoint MUST send a Close frame in response.  (When
+// > sending a Close frame in response, the endpoint typically echos the
+// > status code it received.)
+func (ws *WS) receiveClose(payload []byte) error {
+	closeErr, failCode, err := parseClosePayload(payload)
+	if err != nil {
+		return ws.failConnection(failCode, err)
+	}
+	ws.closeReceived = closeErr
+	if ws.OnClose != nil {
+		ws.OnClose(closeErr.Code, closeErr.Reason)
+	}
+	if err := ws.sendClose(closeErr.Code, ""); err != nil && !errors.Is(err, ErrCloseSent) {
+		return errors.Join(closeErr, err)
+	}
+	return closeErr
+}
+
+// CloseWithCode performs the closing handshake: it sends CLOSE with code and reason, waits for the CLOSE
+// of the peer for at most CloseTimeout and closes the socket.
+// The CLOSE of the peer is waited for by reading the connection, so CloseWithCode must not be called
+// concurrently with ReadMessage or NextReader. To close a connection another goroutine is reading, send
+// CLOSE with SendFrame and let the reading goroutine call CloseWithCode once it receives the CloseError.
+// https://datatracker.ietf.org/doc/html/rfc6455#section-7
+func (ws *WS) CloseWithCode(code WSCloseCode, reason string) error {
+	// RFC 6455 - Section 5.5:
+	// > All control frames MUST have a payload length of 125 bytes or less
+	if !code.isValid() {
+		return ErrBadCloseCode
+	}
+	if len(reason) > 123 {
+		return ErrCloseReasonTooLong
+	}
+	if err := verifyUtf8([]byte(reason)); err != nil {
+		return err
+	}
+	closeErr := ws.sendClose(code, reason)
+	if errors.Is(closeErr, ErrCloseSent) {
+		closeErr = nil
+	}
+	// Both waiting for the CLOSE of the peer and waiting for the end of its input in Close are limited,
+	// a peer that never closes its side of the connection must not keep us here forever
+	if err := ws.Sock.SetReadDeadline(time.Now().Add(ws.closeTimeout())); err != nil && closeErr == nil {
+		closeErr = err
+	}
+	if closeErr == nil && ws.closeReceived == nil {
+		// Everything the peer manages to send before its CLOSE is discarded
+		for closeErr == nil && ws.closeReceived == nil {
+			if _, err := ws.ReadMessage(); err != nil && !errors.Is(err, ErrCloseFrameSent) {
+				closeErr = err
+			}
+		}
+	}
+	if err := ws.Close(); err != nil {
+		return errors.Join(closeErr, err)
+	}
+	return closeErr
+}
+
+func (ws *WS) closeTimeout() time.Duration {
+	if ws.CloseTimeout <= 0 {
+		return defaultCloseTimeout
+	}
+	return ws.CloseTimeout
+}
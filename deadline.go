@@ -0,0 +1,54 @@
+package wsoding
+
+import (
+	"context"
+	"time"
+)
+
+// SetReadDeadline sets the deadline of the following reads, the zero value means no deadline.
+// A read that times out before the next message has started arriving can be retried. One that times out
+// once a message has started, even between its fragments, breaks the connection for reading: every
+// following read returns the same error.
+func (ws *WS) SetReadDeadline(t time.Time) error {
+	ws.deadlineMu.Lock()
+	defer ws.deadlineMu.Unlock()
+	ws.readDeadline = t
+	return ws.Sock.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline of the following writes, the zero value means no deadline.
+// A write that times out breaks the connection for writing, since the peer is left in the middle of a frame.
+func (ws *WS) SetWriteDeadline(t time.Time) error {
+	ws.deadlineMu.Lock()
+	defer ws.deadlineMu.Unlock()
+	ws.writeDeadline = t
+	return ws.Sock.SetWriteDeadline(t)
+}
+
+// ReadMessageContext is ReadMessage that gives up when ctx is done. The connection is left in the same
+// state as after a read that exceeded its deadline, see SetReadDeadline.
+func (ws *WS) ReadMessageContext(ctx context.Context) (message *WSMessage, err error) {
+	ws.deadlineMu.Lock()
+	base := ws.readDeadline
+	ws.deadlineMu.Unlock()
+	finish := watchDeadline(ctx, ws.Sock.SetReadDeadline, base)
+	defer func() {
+		err = finish(err)
+	}()
+	return ws.ReadMessage()
+}
+
+// SendMessageContext is SendMessage that gives up when ctx is done. Waiting for the messages sent
+// concurrently is not interrupted, only the writes of this message are.
+func (ws *WS) SendMessageContext(ctx context.Context, kind WSMessageKind, payload []byte) (err error) {
+	ws.messageMu.Lock()
+	defer ws.messageMu.Unlock()
+	ws.deadlineMu.Lock()
+	base := ws.writeDeadline
+	ws.deadlineMu.Unlock()
+	finish := watchDeadline(ctx, ws.Sock.SetWriteDeadline, base)
+	defer func() {
+		err = finish(err)
+	}()
+	return ws.sendMessage(kind, payload)
+}
@@ -0,0 +1,395 @@
+package wsoding
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"strconv"
+)
+
+const deflateWindowSize int = 1 << 15
+
+// RFC 7692 - Section 7.2.1:
+// > 4.  Remove 4 octets (that are 0x00 0x00 0xff 0xff) from the tail end.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// The tail is followed by an empty final block, so the decompressor reports io.EOF at the end of the message
+var deflateMessageEnd = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// PerMessageDeflate is the permessage-deflate extension.
+// On the client the fields describe what is requested from the server, on the server they are
+// imposed on every client regardless of its offer.
+// https://datatracker.ietf.org/doc/html/rfc7692
+type PerMessageDeflate struct {
+	ServerNoContextTakeover bool
+	ClientNoContextTakeover bool
+	ServerMaxWindowBits     int // 8..15, 0 means no limit
+	ClientMaxWindowBits     int // 8..15, 0 means no limit
+	Level                   int // Compression level of compress/flate, 0 means flate.DefaultCompression
+	Threshold               int // Messages with smaller payload are sent uncompressed
+}
+
+func (pmd *PerMessageDeflate) Name() string {
+	return "permessage-deflate"
+}
+
+func (pmd *PerMessageDeflate) Offer() []ExtensionParams {
+	offer := ExtensionParams{Name: pmd.Name(), Params: make(map[string]string)}
+	if pmd.ServerNoContextTakeover {
+		offer.Params["server_no_context_takeover"] = ""
+	}
+	if pmd.ClientNoContextTakeover {
+		offer.Params["client_no_context_takeover"] = ""
+	}
+	if pmd.ServerMaxWindowBits != 0 {
+		offer.Params["server_max_window_bits"] = strconv.Itoa(pmd.ServerMaxWindowBits)
+	}
+	// Any window the server asks for is fine since it only limits how far back the compressor looks
+	offer.Params["client_max_window_bits"] = ""
+	if pmd.ClientMaxWindowBits != 0 {
+		offer.Params["client_max_window_bits"] = strconv.Itoa(pmd.ClientMaxWindowBits)
+	}
+	return []ExtensionParams{offer}
+}
+
+func (pmd *PerMessageDeflate) Accept(response ExtensionParams) (NegotiatedExtension, error) {
+	params, ok := parseDeflateParams(response)
+	if !ok {
+		return nil, ErrClientHandshakeBadExtension
+	}
+	// RFC 7692 - Section 7.1.2.1:
+	// > If a received extension negotiation response has the
+	// > "server_max_window_bits" extension parameter with a value larger than
+	// > the one in the extension negotiation offer, the client MUST _Fail the
+	// > WebSocket Connection_.
+	if pmd.ServerMaxWindowBits != 0 && (params.serverMaxWindowBits == 0 || params.serverMaxWindowBits > pmd.ServerMaxWindowBits) {
+		return nil, ErrClientHandshakeBadExtension
+	}
+	if params.clientMaxWindowBits == -1 {
+		return nil, ErrClientHandshakeBadExtension
+	}
+	// RFC 7692 - Section 7.1.1.1:
+	// > A client MUST _Fail the WebSocket Connection_ if the peer server
+	// > accepted an extension negotiation offer for this extension with an
+	// > extension negotiation response that doesn't have the
+	// > "server_no_context_takeover" extension parameter, when the client
+	// > has sent the offer with the parameter.
+	if pmd.ServerNoContextTakeover && !params.serverNoContextTakeover {
+		return nil, ErrClientHandshakeBadExtension
+	}
+	windowBits := params.clientMaxWindowBits
+	if pmd.ClientMaxWindowBits != 0 && (windowBits == 0 || pmd.ClientMaxWindowBits < windowBits) {
+		windowBits = pmd.ClientMaxWindowBits
+	}
+	return newDeflateExtension(pmd, params.clientNoContextTakeover || pmd.ClientNoContextTakeover, params.serverNoContextTakeover, windowBits), nil
+}
+
+func (pmd *PerMessageDeflate) Negotiate(offers []ExtensionParams) (ExtensionParams, NegotiatedExtension, bool) {
+	for _, offer := range offers {
+		params, ok := parseDeflateParams(offer)
+		if !ok {
+			continue
+		}
+		response := ExtensionParams{Name: pmd.Name(), Params: make(map[string]string)}
+		serverNoContextTakeover := params.serverNoContextTakeover || pmd.ServerNoContextTakeover
+		if serverNoContextTakeover {
+			response.Params["server_no_context_takeover"] = ""
+		}
+		clientNoContextTakeover := params.clientNoContextTakeover || pmd.ClientNoContextTakeover
+		if clientNoContextTakeover {
+			response.Params["client_no_context_takeover"] = ""
+		}
+		// The window of the server only restricts our compressor
+		windowBits := params.serverMaxWindowBits
+		if pmd.ServerMaxWindowBits != 0 && (windowBits == 0 || pmd.ServerMaxWindowBits < windowBits) {
+			windowBits = pmd.ServerMaxWindowBits
+		}
+		if windowBits != 0 {
+			response.Params["server_max_window_bits"] = strconv.Itoa(windowBits)
+		}
+		// RFC 7692 - Section 7.1.2.2:
+		// > If a received extension negotiation offer doesn't have the
+		// > "client_max_window_bits" extension parameter, the corresponding
+		// > extension negotiation response to the offer MUST NOT include the
+		// > "client_max_window_bits" extension parameter.
+		if params.clientMaxWindowBits != 0 && pmd.ClientMaxWindowBits != 0 {
+			clientWindowBits := pmd.ClientMaxWindowBits
+			if params.clientMaxWindowBits > 0 && params.clientMaxWindowBits < clientWindowBits {
+				clientWindowBits = params.clientMaxWindowBits
+			}
+			response.Params["client_max_window_bits"] = strconv.Itoa(clientWindowBits)
+		}
+		return response, newDeflateExtension(pmd, serverNoContextTakeover, clientNoContextTakeover, windowBits), true
+	}
+	return ExtensionParams{}, nil, false
+}
+
+type deflateParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+	serverMaxWindowBits     int
+	clientMaxWindowBits     int // -1 if the parameter has no value
+}
+
+// RFC 7692 - Section 7.1:
+// > A server MUST decline an extension negotiation offer for this
+// > extension if any of the following conditions are met:
+// > o  The negotiation offer contains an extension parameter not defined
+// >    for use in an offer.
+// > o  The negotiation offer contains an extension parameter with an
+// >    invalid value.
+// > o  The negotiation offer contains multiple extension parameters with
+// >    the same name.
+func parseDeflateParams(extension ExtensionParams) (deflateParams, bool) {
+	var params deflateParams
+	for key, value := range extension.Params {
+		switch key {
+		case "server_no_context_takeover":
+			if value != "" {
+				return deflateParams{}, false
+			}
+			params.serverNoContextTakeover = true
+		case "client_no_context_takeover":
+			if value != "" {
+				return deflateParams{}, false
+			}
+			params.clientNoContextTakeover = true
+		case "server_max_window_bits":
+			bits, ok := parseDeflateWindowBits(value)
+			if !ok {
+				return deflateParams{}, false
+			}
+			params.serverMaxWindowBits = bits
+		case "client_max_window_bits":
+			if value == "" {
+				params.clientMaxWindowBits = -1
+				continue
+			}
+			bits, ok := parseDeflateWindowBits(value)
+			if !ok {
+				return deflateParams{}, false
+			}
+			params.clientMaxWindowBits = bits
+		default:
+			return deflateParams{}, false
+		}
+	}
+	return params, true
+}
+
+// RFC 7692 - Section 7.1.2.1:
+// > The value MUST be an integer in the range 8 to 15 inclusive
+// > and MUST conform to the ABNF below.
+// >     server-max-window-bits = 1*DIGIT
+func parseDeflateWindowBits(value string) (int, bool) {
+	if len(value) == 0 || len(value) > 2 || value[0] == '0' {
+		return 0, false
+	}
+	bits, err := strconv.Atoi(value)
+	if err != nil || bits < 8 || bits > 15 {
+		return 0, false
+	}
+	return bits, true
+}
+
+// deflateExtension is the state of permessage-deflate of a single connection
+type deflateExtension struct {
+	level                 int
+	threshold             int
+	compressNoContext     bool
+	decompressNoContext   bool
+	compressor            *flate.Writer
+	compressorDestination deflateDestination
+	decompressor          io.ReadCloser
+	window                []byte // Tail of the decompressed data that the next message may refer to
+	// Reused from one message to another
+	writer deflateWriter
+	reader deflateReader
+	source deflateSource
+	input  bufio.Reader
+}
+
+func newDeflateExtension(pmd *PerMessageDeflate, compressNoContext, decompressNoContext bool, compressWindowBits int) *deflateExtension {
+	level := pmd.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	// compress/flate always uses the window of 32KiB. Huffman only compression does not refer
+	// back at all, so it honors any window limit the peer asked for.
+	if compressWindowBits != 0 && compressWindowBits < 15 {
+		level = flate.HuffmanOnly
+	}
+	return &deflateExtension{
+		level:               level,
+		threshold:           pmd.Threshold,
+		compressNoContext:   compressNoContext,
+		decompressNoContext: decompressNoContext,
+	}
+}
+
+func (ext *deflateExtension) RSV() byte {
+	return RSV1
+}
+
+func (ext *deflateExtension) NewWriter(w io.WriteCloser, info WSMessageInfo) (io.WriteCloser, byte) {
+	if !info.Compress || (info.Size >= 0 && info.Size < ext.threshold) {
+		return w, 0
+	}
+	if ext.compressor == nil {
+		// Only fails on invalid level
+		compressor, err := flate.NewWriter(&ext.compressorDestination, ext.level)
+		if err != nil {
+			compressor, _ = flate.NewWriter(&ext.compressorDestination, flate.DefaultCompression)
+		}
+		ext.compressor = compressor
+	}
+	writer := &ext.writer
+	*writer = deflateWriter{ext: ext, dst: w}
+	ext.compressorDestination.w = &writer.trimmer
+	writer.trimmer.w = w
+	return writer, RSV1
+}
+
+func (ext *deflateExtension) NewReader(r io.Reader, kind WSMessageKind, rsv byte) io.Reader {
+	if rsv&RSV1 == 0 {
+		return r
+	}
+	ext.source.r = r
+	ext.source.end.Reset(deflateMessageEnd)
+	// The decompressor wraps any input that is not an io.ByteReader into a new bufio.Reader
+	ext.input.Reset(&ext.source)
+	var dict []byte
+	if !ext.decompressNoContext {
+		dict = ext.window
+	}
+	if ext.decompressor == nil {
+		ext.decompressor = flate.NewReaderDict(&ext.input, dict)
+	} else {
+		// Reset of the reader returned by flate.NewReader never fails
+		ext.decompressor.(flate.Resetter).Reset(&ext.input, dict)
+	}
+	ext.reader = deflateReader{ext: ext}
+	return &ext.reader
+}
+
+// deflateSource is the compressed payload of a message followed by deflateMessageEnd
+type deflateSource struct {
+	r   io.Reader
+	end bytes.Reader
+}
+
+func (s *deflateSource) Read(p []byte) (int, error) {
+	if s.r != nil {
+		n, err := s.r.Read(p)
+		if !errors.Is(err, io.EOF) {
+			return n, err
+		}
+		s.r = nil
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return s.end.Read(p)
+}
+
+// deflateDestination lets the compressor keep its context between messages written to different writers
+type deflateDestination struct {
+	w io.Writer
+}
+
+func (d *deflateDestination) Write(p []byte) (int, error) {
+	return d.w.Write(p)
+}
+
+type deflateWriter struct {
+	ext     *deflateExtension
+	dst     io.WriteCloser
+	trimmer deflateTrimmer
+}
+
+func (w *deflateWriter) Write(p []byte) (int, error) {
+	return w.ext.compressor.Write(p)
+}
+
+// RFC 7692 - Section 7.2.1:
+// > 1.  Compress all the octets of the payload of the message using
+// >     DEFLATE.
+// > 2.  If the resulting data does not end with an empty DEFLATE block
+// >     with no compression (the "BTYPE" bits are set to 00), append an
+// >     empty DEFLATE block with no compression to the tail end.
+// > 3.  Remove 4 octets (that are 0x00 0x00 0xff 0xff) from the tail end.
+// >     After this step, the last octet of the compressed data contains
+// >     (possibly part of) the DEFLATE header bits with the "BTYPE" bits
+// >     set to 00.
+func (w *deflateWriter) Close() error {
+	if err := w.ext.compressor.Flush(); err != nil {
+		return err
+	}
+	if !bytes.Equal(w.trimmer.tail[:w.trimmer.n], deflateTail) {
+		return ErrDeflateBadTail
+	}
+	if w.ext.compressNoContext {
+		w.ext.compressor.Reset(&w.ext.compressorDestination)
+	}
+	return w.dst.Close()
+}
+
+// deflateTrimmer holds back the last 4 bytes written to it, they are dropped at the end of the message
+type deflateTrimmer struct {
+	w    io.Writer
+	tail [4]byte
+	n    int
+}
+
+func (t *deflateTrimmer) Write(p []byte) (int, error) {
+	written := len(p)
+	if t.n+len(p) <= len(t.tail) {
+		t.n += copy(t.tail[t.n:], p)
+		return written, nil
+	}
+	// Flushing whatever part of the held back bytes is not going to be the tail anymore
+	if keep := len(t.tail) - len(p); keep > 0 {
+		if _, err := t.w.Write(t.tail[:t.n-keep]); err != nil {
+			return 0, err
+		}
+		copy(t.tail[:], t.tail[t.n-keep:t.n])
+		t.n = keep
+	} else {
+		if _, err := t.w.Write(t.tail[:t.n]); err != nil {
+			return 0, err
+		}
+		t.n = 0
+		if _, err := t.w.Write(p[:len(p)-len(t.tail)]); err != nil {
+			return 0, err
+		}
+		p = p[len(p)-len(t.tail):]
+	}
+	t.n += copy(t.tail[t.n:], p)
+	return written, nil
+}
+
+type deflateReader struct {
+	ext *deflateExtension
+}
+
+func (r *deflateReader) Read(p []byte) (int, error) {
+	n, err := r.ext.decompressor.Read(p)
+	if !r.ext.decompressNoContext {
+		r.ext.remember(p[:n])
+	}
+	return n, err
+}
+
+// remember keeps the last 32KiB of the decompressed data as the dictionary for the next message
+func (ext *deflateExtension) remember(p []byte) {
+	if len(p) >= deflateWindowSize {
+		ext.window = append(ext.window[:0], p[len(p)-deflateWindowSize:]...)
+		return
+	}
+	if overflow := len(ext.window) + len(p) - deflateWindowSize; overflow > 0 {
+		ext.window = append(ext.window[:0], ext.window[overflow:]...)
+	}
+	ext.window = append(ext.window, p...)
+}
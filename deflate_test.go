@@ -0,0 +1,258 @@
+package wsoding
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// testTransport replays the bytes of input and collects what is written
+type testTransport struct {
+	input  io.Reader
+	output bytes.Buffer
+}
+
+func (t *testTransport) Read(p []byte) (int, error)       { return t.input.Read(p) }
+func (t *testTransport) Write(p []byte) (int, error)      { return t.output.Write(p) }
+func (t *testTransport) Close() error                     { return nil }
+func (t *testTransport) SetReadDeadline(time.Time) error  { return nil }
+func (t *testTransport) SetWriteDeadline(time.Time) error { return nil }
+
+// RFC 7692 - Section 7.2.3
+func TestDeflateRFCExamples(t *testing.T) {
+	tests := []struct {
+		name     string
+		frames   []byte
+		messages []string
+	}{
+		{
+			name:     "7.2.3.1 a message compressed using 1 compressed DEFLATE block",
+			frames:   []byte{0xc1, 0x07, 0xf2, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00},
+			messages: []string{"Hello"},
+		},
+		{
+			name: "7.2.3.1 the same message fragmented",
+			frames: []byte{
+				0x41, 0x03, 0xf2, 0x48, 0xcd,
+				0x80, 0x04, 0xc9, 0xc9, 0x07, 0x00,
+			},
+			messages: []string{"Hello"},
+		},
+		{
+			name: "7.2.3.2 sharing LZ77 sliding window",
+			frames: []byte{
+				0xc1, 0x07, 0xf2, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00,
+				0xc1, 0x05, 0xf2, 0x00, 0x11, 0x00, 0x00,
+			},
+			messages: []string{"Hello", "Hello"},
+		},
+		{
+			name:     "7.2.3.3 DEFLATE block with no compression",
+			frames:   []byte{0xc1, 0x0b, 0x00, 0x05, 0x00, 0xfa, 0xff, 0x48, 0x65, 0x6c, 0x6c, 0x6f, 0x00},
+			messages: []string{"Hello"},
+		},
+		{
+			name:     "7.2.3.4 DEFLATE block with BFINAL set to 1",
+			frames:   []byte{0xc1, 0x08, 0xf3, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00, 0x00},
+			messages: []string{"Hello"},
+		},
+		{
+			name:     "uncompressed message between compressed ones",
+			frames:   []byte{0x81, 0x02, 'h', 'i', 0xc1, 0x07, 0xf2, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00},
+			messages: []string{"hi", "Hello"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ext := newDeflateExtension(&PerMessageDeflate{}, false, false, 0)
+			ws := &WS{
+				Sock:       &testTransport{input: bytes.NewReader(tc.frames)},
+				Client:     true,
+				extensions: []NegotiatedExtension{ext},
+			}
+			for _, want := range tc.messages {
+				message, err := ws.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(message.Payload) != want {
+					t.Fatalf("payload = %q, want %q", message.Payload, want)
+				}
+			}
+		})
+	}
+}
+
+// The second message of 7.2.3.2 refers back to the first one, it cannot be decoded without the context
+func TestDeflateNoContextTakeoverDropsWindow(t *testing.T) {
+	frames := []byte{
+		0xc1, 0x07, 0xf2, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00,
+		0xc1, 0x05, 0xf2, 0x00, 0x11, 0x00, 0x00,
+	}
+	ext := newDeflateExtension(&PerMessageDeflate{}, false, true, 0)
+	ws := &WS{
+		Sock:       &testTransport{input: bytes.NewReader(frames)},
+		Client:     true,
+		extensions: []NegotiatedExtension{ext},
+	}
+	if _, err := ws.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := ws.ReadMessage(); err == nil && string(message.Payload) == "Hello" {
+		t.Fatal("the message was decoded with the window of the previous one")
+	}
+}
+
+func TestDeflateCompressorContext(t *testing.T) {
+	compress := func(ext *deflateExtension, payload string) []byte {
+		var output bytes.Buffer
+		w, rsv := ext.NewWriter(nopWriteCloser{&output}, WSMessageInfo{Kind: MessageTEXT, Size: len(payload), Compress: true})
+		if rsv != RSV1 {
+			t.Fatalf("rsv = %03b, want %03b", rsv>>4, RSV1>>4)
+		}
+		if _, err := io.WriteString(w, payload); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return output.Bytes()
+	}
+	// Random letters do not refer back to themselves, only to the previous message
+	r := rand.New(rand.NewSource(1))
+	letters := make([]byte, 300)
+	for i := range letters {
+		letters[i] = byte('a' + r.Intn(26))
+	}
+	payload := string(letters)
+	takeover := newDeflateExtension(&PerMessageDeflate{}, false, false, 0)
+	first := compress(takeover, payload)
+	if second := compress(takeover, payload); len(second) >= len(first) {
+		t.Errorf("with context takeover the repeated message takes %d bytes, the first one %d", len(second), len(first))
+	}
+	noTakeover := newDeflateExtension(&PerMessageDeflate{}, true, false, 0)
+	first = compress(noTakeover, payload)
+	if second := compress(noTakeover, payload); !bytes.Equal(first, second) {
+		t.Errorf("without context takeover the repeated message is compressed to % x, the first one to % x", second, first)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestDeflateRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 10000)
+	r.Read(random)
+	messages := [][]byte{
+		[]byte("Hello"),
+		[]byte("Hello"),
+		{},
+		bytes.Repeat([]byte("compressible "), 10000),
+		random,
+		[]byte("Hello again"),
+	}
+	tests := []struct {
+		name   string
+		client PerMessageDeflate
+		server PerMessageDeflate
+		params map[string]string
+	}{
+		{
+			name:   "context takeover",
+			params: map[string]string{},
+		},
+		{
+			name:   "server_no_context_takeover",
+			client: PerMessageDeflate{ServerNoContextTakeover: true},
+			params: map[string]string{"server_no_context_takeover": ""},
+		},
+		{
+			name:   "client_no_context_takeover",
+			client: PerMessageDeflate{ClientNoContextTakeover: true},
+			params: map[string]string{"client_no_context_takeover": ""},
+		},
+		{
+			name:   "both imposed by the server",
+			server: PerMessageDeflate{ServerNoContextTakeover: true, ClientNoContextTakeover: true},
+			params: map[string]string{"server_no_context_takeover": "", "client_no_context_takeover": ""},
+		},
+		{
+			name:   "window bits",
+			client: PerMessageDeflate{ServerMaxWindowBits: 10},
+			server: PerMessageDeflate{ClientMaxWindowBits: 9},
+			params: map[string]string{"server_max_window_bits": "10", "client_max_window_bits": "9"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := deflatePair(t, &tc.client, &tc.server)
+			if len(client.Extensions) != 1 || fmt.Sprint(client.Extensions[0].Params) != fmt.Sprint(tc.params) {
+				t.Fatalf("negotiated %v, want params %v", client.Extensions, tc.params)
+			}
+			go func() {
+				for {
+					message, err := server.ReadMessage()
+					if err != nil {
+						return
+					}
+					if err := server.SendMessage(message.Kind, message.Payload); err != nil {
+						return
+					}
+				}
+			}()
+			for i, payload := range messages {
+				if err := client.SendBinary(payload); err != nil {
+					t.Fatal(err)
+				}
+				message, err := client.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(message.Payload, payload) {
+					t.Fatalf("message %d came back different", i)
+				}
+			}
+		})
+	}
+}
+
+func deflatePair(t *testing.T, clientDeflate, serverDeflate *PerMessageDeflate) (*WS, *WS) {
+	return pipePair(t, &DialOptions{Extensions: []Extension{clientDeflate}}, &AcceptOptions{Extensions: []Extension{serverDeflate}})
+}
+
+// pipePair connects a client and a server through net.Pipe
+func pipePair(t *testing.T, dialOpts *DialOptions, acceptOpts *AcceptOptions) (*WS, *WS) {
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	accepted := make(chan *WS, 1)
+	go func() {
+		ws, err := Accept(ctx, serverConn, acceptOpts)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- ws
+	}()
+	client, err := Connect(ctx, clientConn, "localhost", "/", dialOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		t.FailNow()
+	}
+	return client, server
+}
@@ -0,0 +1,165 @@
+package wsoding
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"syscall"
+
+	"github.com/mdlayher/socket"
+	"golang.org/x/sys/unix"
+)
+
+type DialOptions struct {
+	Debug bool
+	// Subprotocols offered to the server through Sec-WebSocket-Protocol in the order of preference
+	Subprotocols []string
+	// Extensions offered to the server through Sec-WebSocket-Extensions in the order of preference
+	Extensions []Extension
+	// TLSConfig of wss:// connections, custom root CAs go to its RootCAs.
+	// ServerName defaults to the host of the URL.
+	TLSConfig *tls.Config
+	// PinnedKeys are SHA-256 digests of the SubjectPublicKeyInfo of trusted certificates. When set, the
+	// chain of the server must contain one of them in addition to passing the usual verification.
+	PinnedKeys [][]byte
+}
+
+// Dial connects to the WebSocket server at the ws:// or wss:// URL rawURL and performs the client handshake.
+// https://datatracker.ietf.org/doc/html/rfc6455#section-3
+func Dial(ctx context.Context, rawURL string, opts *DialOptions) (*WS, error) {
+	if opts == nil {
+		opts = &DialOptions{}
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	var defaultPort string
+	switch u.Scheme {
+	case "ws":
+		defaultPort = "80"
+	case "wss":
+		defaultPort = "443"
+	default:
+		return nil, ErrDialBadScheme
+	}
+	// RFC 6455 - Section 3:
+	// > Fragment identifiers are meaningless in the context of WebSocket URIs
+	// > and MUST NOT be used on these URIs.
+	if u.Fragment != "" || u.Opaque != "" || u.User != nil {
+		return nil, ErrDialBadURL
+	}
+	hostname := u.Hostname()
+	if hostname == "" {
+		return nil, ErrDialBadURL
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil || portNum <= 0 || portNum > 0xFFFF {
+		return nil, ErrDialBadURL
+	}
+	sock, err := dialSocket(ctx, hostname, portNum)
+	if err != nil {
+		return nil, err
+	}
+	var transport Transport = sock
+	if u.Scheme == "wss" {
+		tlsConn, err := dialTLS(ctx, sock, hostname, opts)
+		if err != nil {
+			sock.Close()
+			return nil, err
+		}
+		transport = tlsConn
+	}
+	ws := &WS{
+		Sock:   transport,
+		Debug:  opts.Debug,
+		Client: true,
+	}
+	if err := ws.ClientHandshake(ctx, hostHeader(hostname, port, defaultPort), u.RequestURI(), opts); err != nil {
+		transport.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// hostHeader builds the value of the Host header, the port is omitted if it is the default one for the scheme
+func hostHeader(hostname, port, defaultPort string) string {
+	// The zone of an IPv6 literal only makes sense locally
+	if addr, err := netip.ParseAddr(hostname); err == nil {
+		hostname = addr.WithZone("").String()
+	}
+	if port == defaultPort {
+		if addr, err := netip.ParseAddr(hostname); err == nil && addr.Is6() {
+			return "[" + hostname + "]"
+		}
+		return hostname
+	}
+	return net.JoinHostPort(hostname, port)
+}
+
+func dialSocket(ctx context.Context, hostname string, port int) (*socket.Conn, error) {
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(hostname); err == nil {
+		addrs = []netip.Addr{addr}
+	} else {
+		addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", hostname)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Trying every resolved address in order until one of them accepts the connection
+	var firstErr error
+	for _, addr := range addrs {
+		sock, err := connectSocket(ctx, addr, port)
+		if err == nil {
+			return sock, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = ErrDialNoAddress
+	}
+	return nil, firstErr
+}
+
+func connectSocket(ctx context.Context, addr netip.Addr, port int) (*socket.Conn, error) {
+	family, sa := inetSockaddr(addr, port)
+	sock, err := socket.Socket(family, syscall.SOCK_STREAM, 0, "wsoding-dial", nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := sock.Connect(ctx, sa); err != nil {
+		sock.Close()
+		return nil, err
+	}
+	return sock, nil
+}
+
+// inetSockaddr returns the address family and the socket address of addr and port
+func inetSockaddr(addr netip.Addr, port int) (int, unix.Sockaddr) {
+	addr = addr.Unmap()
+	if addr.Is4() {
+		return syscall.AF_INET, &unix.SockaddrInet4{Port: port, Addr: addr.As4()}
+	}
+	sa := &unix.SockaddrInet6{Port: port, Addr: addr.As16()}
+	if zone := addr.Zone(); zone != "" {
+		if iface, err := net.InterfaceByName(zone); err == nil {
+			sa.ZoneId = uint32(iface.Index)
+		} else if index, err := strconv.ParseUint(zone, 10, 32); err == nil {
+			sa.ZoneId = uint32(index)
+		}
+	}
+	return syscall.AF_INET6, sa
+}
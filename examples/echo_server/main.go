@@ -5,55 +5,49 @@ import (
 	"fmt"
 	"log"
 	"net/netip"
-	"syscall"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
 
-	"github.com/mdlayher/socket"
 	"github.com/shadowy-pycoder/wsoding"
 	"github.com/shadowy-pycoder/wsoding/examples/internal/config"
 	"github.com/shadowy-pycoder/wsoding/examples/internal/echo"
-	"golang.org/x/sys/unix"
 )
 
 func main() {
-	// TODO: Turn example_server into an asynchronous echo server that just continuosly echos all the client messages
-	// until the client closes the connection. I think some of the Autobahn Test Cases depends on this exact behavior.
-	// This may require implementing proper periodic pinging of the clients and closing those who fell off.
-	// (Which I believe is also part of some of the Autobahn Test Cases).
-	server, err := socket.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0, "wsoding-server", nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-	err = server.SetsockoptInt(syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
-	if err != nil {
-		log.Fatal(err)
-	}
-	err = server.Bind(&unix.SockaddrInet4{Port: config.Port, Addr: config.Host})
-	if err != nil {
-		log.Fatal(err)
-	}
-	err = server.Listen(10)
-	if err != nil {
-		log.Fatal(err)
-	}
-	ctx := context.Background()
-	fmt.Printf("Listening to %s:%d\n", netip.AddrFrom4(config.Host), config.Port)
-	for {
-		client, addr, err := server.Accept(ctx, 0)
-		if err != nil {
+	server := &wsoding.Server{
+		Handler: func(ws *wsoding.WS) {
+			fmt.Printf("%s Client connected\n", ws.RemoteAddr())
+			echo.Serve(ws)
+		},
+		AcceptOptions: &wsoding.AcceptOptions{
+			// Set through the options, the keepalive goroutine already runs when Handler is called
+			Debug:      true,
+			Extensions: []wsoding.Extension{&wsoding.PerMessageDeflate{}},
+		},
+		// Clients that fell off without closing the connection are dropped
+		PingInterval: 30 * time.Second,
+		OnHandshakeError: func(err error) {
 			log.Println(err)
-			continue
-		}
-		address := (addr).(*unix.SockaddrInet4)
-		fmt.Printf("%s:%d Client connected\n", netip.AddrFrom4(address.Addr), address.Port)
-		ws, err := wsoding.Accept(ctx, client)
-		if err != nil {
+		},
+	}
+	address := netip.AddrFrom4(config.Host).String() + ":" + strconv.Itoa(config.Port)
+	shutdown := make(chan struct{})
+	go (func() {
+		defer close(shutdown)
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		<-interrupt
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
 			log.Println(err)
-			if err = client.Close(); err != nil {
-				log.Println(err)
-				continue
-			}
 		}
-		ws.Debug = true
-		go echo.Serve(ws)
+	})()
+	fmt.Printf("Listening to %s\n", address)
+	if err := server.ListenAndServe("tcp4", address); err != wsoding.ErrServerClosed {
+		log.Fatal(err)
 	}
+	<-shutdown
 }
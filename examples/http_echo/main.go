@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+
+	"github.com/shadowy-pycoder/wsoding"
+	"github.com/shadowy-pycoder/wsoding/examples/internal/config"
+	"github.com/shadowy-pycoder/wsoding/examples/internal/echo"
+)
+
+func main() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "Hello from net/http, the echo WebSocket is at /\n")
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		ws, err := wsoding.Upgrade(w, r, &wsoding.AcceptOptions{
+			Extensions: []wsoding.Extension{&wsoding.PerMessageDeflate{}},
+		})
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		fmt.Printf("%s Client connected\n", r.RemoteAddr)
+		echo.Serve(ws)
+	})
+	addr := netip.AddrPortFrom(netip.AddrFrom4(config.Host), uint16(config.HTTPPort)).String()
+	fmt.Printf("Listening to %s\n", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
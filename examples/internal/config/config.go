@@ -1,6 +1,8 @@
 package config
 
 var (
-	Host = [4]byte{0x7f, 0x00, 0x00, 0x01}
-	Port = 9001
+	Host     = [4]byte{0x7f, 0x00, 0x00, 0x01}
+	Port     = 9001
+	TLSPort  = 9443
+	HTTPPort = 9080
 )
@@ -8,16 +8,9 @@ import (
 	"github.com/shadowy-pycoder/wsoding"
 )
 
-func Serve(ws wsoding.WS) {
+func Serve(ws *wsoding.WS) {
 	defer (func() {
-		// TODO: Tuck sending the CLOSE frame under some abstraction of "Closing the WebSocket".
-		// Maybe some sort of ws.close() method.
-		// TODO: The sender may give a reason of the close via the status code
-		// See RFC6466, Section 7.4
-		if err := ws.SendFrame(true, wsoding.OpCodeCLOSE, []byte{}); err != nil {
-			log.Println(err)
-		}
-		if err := ws.Close(); err != nil {
+		if err := ws.CloseWithCode(wsoding.CloseNormalClosure, ""); err != nil {
 			log.Println(err)
 		}
 	})()
@@ -28,8 +21,9 @@ func Serve(ws wsoding.WS) {
 	for i := 0; ; i++ {
 		message, err := ws.ReadMessage()
 		if err != nil {
-			if errors.Is(err, wsoding.ErrCloseFrameSent) {
-				log.Printf("INFO: %s closed connection\n", peerWho)
+			var closeErr *wsoding.CloseError
+			if errors.As(err, &closeErr) {
+				log.Printf("INFO: %s closed connection: %d %s\n", peerWho, closeErr.Code, closeErr.Reason)
 			} else {
 				log.Printf("ERROR: %s connection failed: %s\n", peerWho, err)
 			}
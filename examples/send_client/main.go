@@ -6,15 +6,12 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/netip"
 	"os"
 	"strconv"
-	"syscall"
 
-	"github.com/mdlayher/socket"
 	"github.com/shadowy-pycoder/wsoding"
-	"github.com/shadowy-pycoder/wsoding/examples/internal/config"
-	"golang.org/x/sys/unix"
 )
 
 func shift(xs *[]string) string {
@@ -51,34 +48,19 @@ func main() {
 		log.Fatal("ERROR: no message is provided")
 	}
 	message := shift(&args)
-	client, err := socket.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0, "wsoding-send-client", nil)
-	if err != nil {
-		log.Fatal(err)
-	}
 	ctx := context.Background()
-	_, err = client.Connect(ctx, &unix.SockaddrInet4{Port: port, Addr: host.As4()})
+	url := fmt.Sprintf("ws://%s/", net.JoinHostPort(host.String(), strconv.Itoa(port)))
+	ws, err := wsoding.Dial(ctx, url, &wsoding.DialOptions{Debug: true})
 	if err != nil {
 		log.Fatal(err)
 	}
-	ws := wsoding.WS{
-		Sock:   client,
-		Debug:  true,
-		Client: true,
-	}
 	defer (func() {
-		if err := ws.SendFrame(true, wsoding.OpCodeCLOSE, []byte{}); err != nil {
-			log.Fatal(err)
-		}
-		if err = ws.Close(); err != nil {
+		if err = ws.CloseWithCode(wsoding.CloseNormalClosure, ""); err != nil {
 			if !errors.Is(err, io.EOF) {
 				log.Fatal(err)
 			}
 		}
 	})()
-	hostPort := fmt.Sprintf("%s:%d", host, config.Port)
-	if err := ws.ClientHandshake(ctx, hostPort, "/"); err != nil {
-		log.Fatal(err)
-	}
 	if err := ws.SendText(message); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/shadowy-pycoder/wsoding"
+	"github.com/shadowy-pycoder/wsoding/examples/internal/config"
+)
+
+// selfSignedCertificate generates a throwaway certificate for the loopback address
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "wsoding"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IP(config.Host[:])},
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func main() {
+	cert, err := selfSignedCertificate()
+	if err != nil {
+		log.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := &wsoding.Server{
+		Handler: func(ws *wsoding.WS) {
+			defer ws.CloseWithCode(wsoding.CloseNormalClosure, "")
+			for {
+				message, err := ws.ReadMessage()
+				if err != nil {
+					return
+				}
+				if err := ws.SendMessage(message.Kind, message.Payload); err != nil {
+					return
+				}
+			}
+		},
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		OnHandshakeError: func(err error) {
+			log.Println(err)
+		},
+	}
+	address := netip.AddrPortFrom(netip.AddrFrom4(config.Host), uint16(config.TLSPort)).String()
+	if err := server.Listen("tcp4", address); err != nil {
+		log.Fatal(err)
+	}
+	defer server.Close()
+	go server.Serve()
+
+	// The certificate is not signed by anybody, so the client trusts it as its own root CA
+	// and additionally pins its public key
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	pin := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	url := fmt.Sprintf("wss://%s:%d/", netip.AddrFrom4(config.Host), config.TLSPort)
+	ws, err := wsoding.Dial(context.Background(), url, &wsoding.DialOptions{
+		Debug:      true,
+		TLSConfig:  &tls.Config{RootCAs: roots},
+		PinnedKeys: [][]byte{pin[:]},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	state, _ := ws.TLSConnectionState()
+	fmt.Printf("Connected to %s with %s\n", url, tls.VersionName(state.Version))
+	if err := ws.SendText("Hello, TLS"); err != nil {
+		log.Fatal(err)
+	}
+	message, err := ws.ReadMessage()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Message from server: %s\n", message.Payload)
+	if err := ws.CloseWithCode(wsoding.CloseNormalClosure, ""); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,292 @@
+package wsoding
+
+import (
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Reserved bits of the first byte of the frame header that extensions may claim
+const (
+	RSV1 byte = 1 << 6
+	RSV2 byte = 1 << 5
+	RSV3 byte = 1 << 4
+)
+
+// ExtensionParams is a single element of the Sec-WebSocket-Extensions header.
+// Parameters without a value are mapped to an empty string.
+// https://datatracker.ietf.org/doc/html/rfc6455#section-9.1
+type ExtensionParams struct {
+	Name   string
+	Params map[string]string
+}
+
+func (p ExtensionParams) String() string {
+	var sb strings.Builder
+	sb.WriteString(p.Name)
+	keys := make([]string, 0, len(p.Params))
+	for key := range p.Params {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		sb.WriteString("; ")
+		sb.WriteString(key)
+		if value := p.Params[key]; value != "" {
+			sb.WriteString("=")
+			if isHTTPToken(value) {
+				sb.WriteString(value)
+			} else {
+				sb.WriteString(`"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`)
+			}
+		}
+	}
+	return sb.String()
+}
+
+// Extension is the configuration of an extension that a client offers or a server is willing to accept.
+// The same Extension is shared by many connections, the state of a single connection lives in the
+// NegotiatedExtension it creates.
+type Extension interface {
+	// Name is the extension token used in Sec-WebSocket-Extensions
+	Name() string
+	// Offer returns the offers of the client in the order of preference
+	Offer() []ExtensionParams
+	// Accept is called on the client with the parameters the server responded with
+	Accept(response ExtensionParams) (NegotiatedExtension, error)
+	// Negotiate is called on the server with all the offers of the client for this extension.
+	// It returns the parameters of the response, or false to decline every offer.
+	Negotiate(offers []ExtensionParams) (ExtensionParams, NegotiatedExtension, bool)
+}
+
+// NegotiatedExtension transforms the payload of the data messages of a single connection.
+// Extensions are applied to outgoing messages in the order they were negotiated in
+// and to incoming messages in the reverse order.
+type NegotiatedExtension interface {
+	// RSV returns the reserved bits claimed by the extension. They are allowed only on the first
+	// frame of a data message.
+	RSV() byte
+	// NewWriter wraps the writer of the payload of an outgoing message. It also returns the reserved
+	// bits to set on the first frame of the message, 0 if the message is passed as is.
+	NewWriter(w io.WriteCloser, info WSMessageInfo) (io.WriteCloser, byte)
+	// NewReader wraps the reader of the payload of an incoming message which first frame had
+	// the reserved bits rsv set.
+	NewReader(r io.Reader, kind WSMessageKind, rsv byte) io.Reader
+}
+
+// WSMessageInfo describes an outgoing message to the extensions
+type WSMessageInfo struct {
+	Kind     WSMessageKind
+	Size     int  // Size of the payload, -1 if it is not known in advance
+	Compress bool // False if the compression is disabled for the message, see WS.EnableWriteCompression
+}
+
+// parseExtensions parses the value of the Sec-WebSocket-Extensions header fields.
+//
+// RFC 6455 - Section 9.1:
+// > extension-list = 1#extension
+// > extension = extension-token *( ";" extension-param )
+// > extension-token = registered-token
+// > registered-token = token
+// > extension-param = token [ "=" (token | quoted-string) ]
+func parseExtensions(header http.Header) ([]ExtensionParams, error) {
+	var extensions []ExtensionParams
+	for _, value := range header.Values("Sec-WebSocket-Extensions") {
+		s := value
+		for {
+			s = strings.TrimLeft(s, " \t")
+			if s == "" {
+				break
+			}
+			if s[0] == ',' {
+				s = s[1:]
+				continue
+			}
+			var name string
+			name, s = cutToken(s)
+			if name == "" {
+				return nil, ErrBadExtensions
+			}
+			extension := ExtensionParams{Name: name, Params: make(map[string]string)}
+			for {
+				s = strings.TrimLeft(s, " \t")
+				if s == "" || s[0] == ',' {
+					break
+				}
+				if s[0] != ';' {
+					return nil, ErrBadExtensions
+				}
+				s = strings.TrimLeft(s[1:], " \t")
+				var key, value string
+				key, s = cutToken(s)
+				if key == "" {
+					return nil, ErrBadExtensions
+				}
+				s = strings.TrimLeft(s, " \t")
+				if s != "" && s[0] == '=' {
+					s = strings.TrimLeft(s[1:], " \t")
+					var ok bool
+					if s != "" && s[0] == '"' {
+						value, s, ok = cutQuotedString(s)
+					} else {
+						value, s = cutToken(s)
+						ok = value != ""
+					}
+					// RFC 6455 - Section 9.1:
+					// > When using the quoted-string syntax variant, the value
+					// > after quoted-string unescaping MUST conform to the
+					// > 'token' ABNF.
+					if !ok || !isHTTPToken(value) {
+						return nil, ErrBadExtensions
+					}
+				}
+				if _, ok := extension.Params[key]; ok {
+					return nil, ErrBadExtensions
+				}
+				extension.Params[key] = value
+			}
+			extensions = append(extensions, extension)
+		}
+	}
+	return extensions, nil
+}
+
+func cutToken(s string) (string, string) {
+	i := 0
+	for i < len(s) && isHTTPToken(s[i:i+1]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func cutQuotedString(s string) (string, string, bool) {
+	var sb strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return sb.String(), s[i+1:], true
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", "", false
+			}
+		}
+		sb.WriteByte(s[i])
+	}
+	return "", "", false
+}
+
+// negotiateExtensions picks the extensions the server responds with among the offers of the client
+func (ws *WS) negotiateExtensions(request *WSRequest, extensions []Extension) {
+	if len(extensions) == 0 {
+		return
+	}
+	// RFC 6455 - Section 9.1:
+	// > Note that like other HTTP header fields, this header field MAY be
+	// > split or combined across multiple lines.
+	// A malformed header just means that none of the extensions are accepted
+	offers, err := parseExtensions(request.Header)
+	if err != nil || len(offers) == 0 {
+		return
+	}
+	var rsv byte
+	for _, extension := range extensions {
+		var matching []ExtensionParams
+		for _, offer := range offers {
+			if offer.Name == extension.Name() {
+				matching = append(matching, offer)
+			}
+		}
+		if len(matching) == 0 {
+			continue
+		}
+		response, negotiated, ok := extension.Negotiate(matching)
+		if !ok || negotiated.RSV()&rsv != 0 {
+			continue
+		}
+		rsv |= negotiated.RSV()
+		ws.Extensions = append(ws.Extensions, response)
+		ws.extensions = append(ws.extensions, negotiated)
+	}
+}
+
+// acceptExtensions verifies the extensions the server responded with against the ones offered by the client
+func (ws *WS) acceptExtensions(header http.Header, extensions []Extension) error {
+	responses, err := parseExtensions(header)
+	if err != nil {
+		return err
+	}
+	var rsv byte
+	for _, response := range responses {
+		// RFC 6455 - Section 4.1:
+		// > If the response includes a |Sec-WebSocket-Extensions| header
+		// > field and this header field indicates the use of an extension
+		// > that was not present in the client's handshake (the server has
+		// > indicated an extension not requested by the client), the client
+		// > MUST _Fail the WebSocket Connection_.
+		index := slices.IndexFunc(extensions, func(extension Extension) bool {
+			return extension.Name() == response.Name
+		})
+		if index == -1 {
+			return ErrClientHandshakeBadExtension
+		}
+		if slices.ContainsFunc(ws.Extensions, func(accepted ExtensionParams) bool {
+			return accepted.Name == response.Name
+		}) {
+			return ErrClientHandshakeBadExtension
+		}
+		negotiated, err := extensions[index].Accept(response)
+		if err != nil {
+			return err
+		}
+		if negotiated.RSV()&rsv != 0 {
+			return ErrClientHandshakeBadExtension
+		}
+		rsv |= negotiated.RSV()
+		ws.Extensions = append(ws.Extensions, response)
+		ws.extensions = append(ws.extensions, negotiated)
+	}
+	return nil
+}
+
+func offerExtensions(extensions []Extension) string {
+	var offers []string
+	for _, extension := range extensions {
+		for _, offer := range extension.Offer() {
+			offers = append(offers, offer.String())
+		}
+	}
+	return strings.Join(offers, ", ")
+}
+
+func formatExtensions(extensions []ExtensionParams) string {
+	var responses []string
+	for _, extension := range extensions {
+		responses = append(responses, extension.String())
+	}
+	return strings.Join(responses, ", ")
+}
+
+// EnableWriteCompression turns the compression of the following outgoing messages on or off.
+// It only has an effect when a compression extension was negotiated, and it is on by default.
+func (ws *WS) EnableWriteCompression(enable bool) {
+	ws.noWriteCompression = !enable
+}
+
+// negotiatedRSV returns all the reserved bits claimed by the negotiated extensions
+func (ws *WS) negotiatedRSV() byte {
+	var rsv byte
+	for _, extension := range ws.extensions {
+		rsv |= extension.RSV()
+	}
+	return rsv
+}
+
+// decodeMessage passes the payload of an incoming message through the negotiated extensions
+func (ws *WS) decodeMessage(kind WSMessageKind, rsv byte, r io.Reader) io.Reader {
+	for i := len(ws.extensions) - 1; i >= 0; i-- {
+		r = ws.extensions[i].NewReader(r, kind, rsv)
+	}
+	return r
+}
@@ -0,0 +1,136 @@
+package wsoding
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseExtensions(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []ExtensionParams
+		err    error
+	}{
+		{
+			name:   "none",
+			values: nil,
+			want:   nil,
+		},
+		{
+			name:   "name only",
+			values: []string{"permessage-deflate"},
+			want:   []ExtensionParams{{Name: "permessage-deflate", Params: map[string]string{}}},
+		},
+		{
+			name:   "params",
+			values: []string{"permessage-deflate; client_max_window_bits; server_max_window_bits=10"},
+			want: []ExtensionParams{{Name: "permessage-deflate", Params: map[string]string{
+				"client_max_window_bits": "",
+				"server_max_window_bits": "10",
+			}}},
+		},
+		{
+			name:   "whitespace",
+			values: []string{" \tfoo \t;\t a \t= \t1 \t, \tbar "},
+			want: []ExtensionParams{
+				{Name: "foo", Params: map[string]string{"a": "1"}},
+				{Name: "bar", Params: map[string]string{}},
+			},
+		},
+		{
+			name:   "quoted-string param",
+			values: []string{`foo; a="10"; b="x\yz"`},
+			want:   []ExtensionParams{{Name: "foo", Params: map[string]string{"a": "10", "b": "xyz"}}},
+		},
+		{
+			name:   "multiple extensions in one line",
+			values: []string{"foo, bar; x, foo; y=2"},
+			want: []ExtensionParams{
+				{Name: "foo", Params: map[string]string{}},
+				{Name: "bar", Params: map[string]string{"x": ""}},
+				{Name: "foo", Params: map[string]string{"y": "2"}},
+			},
+		},
+		{
+			name:   "split across lines",
+			values: []string{"foo; x", "bar"},
+			want: []ExtensionParams{
+				{Name: "foo", Params: map[string]string{"x": ""}},
+				{Name: "bar", Params: map[string]string{}},
+			},
+		},
+		{
+			name:   "empty elements",
+			values: []string{",, foo ,,", ""},
+			want:   []ExtensionParams{{Name: "foo", Params: map[string]string{}}},
+		},
+		{
+			name:   "duplicate param",
+			values: []string{"foo; a=1; a=2"},
+			err:    ErrBadExtensions,
+		},
+		{
+			name:   "duplicate param without value",
+			values: []string{"foo; a; a"},
+			err:    ErrBadExtensions,
+		},
+		{
+			name:   "quoted value that is not a token",
+			values: []string{`foo; a="1 2"`},
+			err:    ErrBadExtensions,
+		},
+		{
+			name:   "unterminated quoted-string",
+			values: []string{`foo; a="10`},
+			err:    ErrBadExtensions,
+		},
+		{
+			name:   "escape at the end",
+			values: []string{`foo; a="10\`},
+			err:    ErrBadExtensions,
+		},
+		{
+			name:   "missing value",
+			values: []string{"foo; a="},
+			err:    ErrBadExtensions,
+		},
+		{
+			name:   "missing name",
+			values: []string{"; a=1"},
+			err:    ErrBadExtensions,
+		},
+		{
+			name:   "missing param name",
+			values: []string{"foo; =1"},
+			err:    ErrBadExtensions,
+		},
+		{
+			name:   "garbage after the name",
+			values: []string{"foo bar"},
+			err:    ErrBadExtensions,
+		},
+	}
+	for _, tc := range tests {
+		header := http.Header{}
+		for _, value := range tc.values {
+			header.Add("Sec-WebSocket-Extensions", value)
+		}
+		got, err := parseExtensions(header)
+		if tc.err != nil {
+			if !errors.Is(err, tc.err) {
+				t.Errorf("%s: err = %v, want %v", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package wsoding
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const defaultMaxHeaderBytes int = 64 * 1024
+const maxResponseBodyBytes int = 64 * 1024
+
+// WSRequest is the HTTP/1.1 upgrade request received by the server during the handshake
+type WSRequest struct {
+	Method     string
+	RequestURI string // Request target exactly as it was sent by the client
+	Path       string
+	RawQuery   string
+	Query      url.Values
+	Proto      string
+	ProtoMajor int
+	ProtoMinor int
+	Header     http.Header
+}
+
+// RejectError describes the HTTP response sent to the client when the server refuses the upgrade
+type RejectError struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Err        error // Reason of the rejection, if any
+}
+
+func (e *RejectError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("server handshake rejected with %d: %s", e.StatusCode, e.Err)
+	}
+	return fmt.Sprintf("server handshake rejected with %d", e.StatusCode)
+}
+
+func (e *RejectError) Unwrap() error {
+	return e.Err
+}
+
+// HandshakeResponseError is returned by the client when the server answers the upgrade request
+// with anything other than 101 Switching Protocols
+type HandshakeResponseError struct {
+	StatusCode int
+	Status     string // Status line without the protocol, e.g. "404 Not Found"
+	Proto      string
+	Header     http.Header
+	Body       []byte // Body of the response, truncated to 64KiB
+}
+
+func (e *HandshakeResponseError) Error() string {
+	return fmt.Sprintf("client handshake unexpected response: %s", e.Status)
+}
+
+// httpHeadParser incrementally parses the start line and the header fields of an HTTP/1.1 message.
+// https://datatracker.ietf.org/doc/html/rfc7230#section-3
+type httpHeadParser struct {
+	maxBytes  int
+	size      int
+	line      []byte
+	startLine string
+	header    http.Header
+	lastKey   string
+	done      bool
+}
+
+func newHTTPHeadParser(maxBytes int) *httpHeadParser {
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxHeaderBytes
+	}
+	return &httpHeadParser{
+		maxBytes: maxBytes,
+		header:   make(http.Header),
+	}
+}
+
+// feed consumes the bytes of data up to and including the empty line that terminates the head.
+// Returns the amount of consumed bytes, anything after them does not belong to the head.
+func (p *httpHeadParser) feed(data []byte) (int, error) {
+	consumed := 0
+	for !p.done && consumed < len(data) {
+		index := bytes.IndexByte(data[consumed:], '\n')
+		end := len(data)
+		if index != -1 {
+			end = consumed + index + 1
+		}
+		if p.size+end-consumed > p.maxBytes {
+			return consumed, ErrHeaderTooLarge
+		}
+		p.size += end - consumed
+		p.line = append(p.line, data[consumed:end]...)
+		consumed = end
+		if index == -1 {
+			break
+		}
+		line := p.line
+		p.line = p.line[:0]
+		// RFC 7230 - Section 3.5:
+		// > Although the line terminator for the start-line and header fields is
+		// > the sequence CRLF, a recipient MAY recognize a single LF as a line
+		// > terminator and ignore any preceding CR.
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if err := p.parseLine(string(line)); err != nil {
+			return consumed, err
+		}
+	}
+	return consumed, nil
+}
+
+func (p *httpHeadParser) parseLine(line string) error {
+	if p.startLine == "" {
+		// RFC 7230 - Section 3.5:
+		// > In the interest of robustness, a server that is expecting to receive
+		// > and parse a request-line SHOULD ignore at least one empty line (CRLF)
+		// > received prior to the request-line.
+		if line == "" && p.size <= len("\r\n") {
+			return nil
+		}
+		if line == "" {
+			return ErrHTTPBadStartLine
+		}
+		p.startLine = line
+		return nil
+	}
+	if line == "" {
+		p.done = true
+		return nil
+	}
+	// RFC 7230 - Section 3.2.4:
+	// > A server that receives an obs-fold in a request message ... MUST either
+	// > reject the message ... or replace each received obs-fold with one or more SP octets
+	if line[0] == ' ' || line[0] == '\t' {
+		if p.lastKey == "" {
+			return ErrHTTPBadHeader
+		}
+		values := p.header[p.lastKey]
+		values[len(values)-1] = strings.TrimSpace(values[len(values)-1] + " " + strings.TrimSpace(line))
+		return nil
+	}
+	index := strings.IndexByte(line, ':')
+	if index <= 0 {
+		return ErrHTTPBadHeader
+	}
+	key := line[:index]
+	// RFC 7230 - Section 3.2.4:
+	// > No whitespace is allowed between the header field-name and colon.
+	if !isHTTPToken(key) {
+		return ErrHTTPBadHeader
+	}
+	p.lastKey = http.CanonicalHeaderKey(key)
+	p.header.Add(p.lastKey, strings.Trim(line[index+1:], " \t"))
+	return nil
+}
+
+// readHTTPHead reads the head of an HTTP message, anything past it is left in the buffered reader
+func (ws *WS) readHTTPHead(maxBytes int) (*httpHeadParser, error) {
+	parser := newHTTPHeadParser(maxBytes)
+	reader := ws.bufferedReader()
+	for !parser.done {
+		// Waiting for at least one byte and then looking at everything that has arrived so far
+		if _, err := reader.Peek(1); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		buffer, _ := reader.Peek(reader.Buffered())
+		consumed, err := parser.feed(buffer)
+		if err != nil {
+			return nil, err
+		}
+		reader.Discard(consumed)
+	}
+	return parser, nil
+}
+
+// rejectHandshake sends the HTTP error response corresponding to err and returns err back.
+// Errors of the socket itself are returned as is since nobody is listening for the response anyway.
+func (ws *WS) rejectHandshake(err error) error {
+	reject := handshakeRejection(err)
+	if reject == nil {
+		return err
+	}
+	if writeErr := ws.writeHTTPResponse(reject.StatusCode, reject.Header, reject.Body); writeErr != nil {
+		return errors.Join(reject, writeErr)
+	}
+	return reject
+}
+
+// handshakeRejection describes the HTTP response to the failed handshake, nil if err is not worth responding to
+func handshakeRejection(err error) *RejectError {
+	var reject *RejectError
+	if !errors.As(err, &reject) {
+		reject = &RejectError{Err: err}
+		switch {
+		case errors.Is(err, ErrServerHandshakeBadVersion):
+			// RFC 6455 - Section 4.4:
+			// > If the server doesn't support the requested version, it MUST respond
+			// > with a |Sec-WebSocket-Version| header field (or multiple
+			// > |Sec-WebSocket-Version| header fields) containing all versions it is
+			// > willing to use.
+			reject.StatusCode = http.StatusUpgradeRequired
+			reject.Header = http.Header{"Sec-Websocket-Version": {"13"}}
+		case errors.Is(err, ErrServerHandshakeBadOrigin):
+			reject.StatusCode = http.StatusForbidden
+		case errors.Is(err, ErrHeaderTooLarge):
+			reject.StatusCode = http.StatusRequestHeaderFieldsTooLarge
+		case errors.Is(err, ErrServerHandshakeBadRequest),
+			errors.Is(err, ErrServerHandshakeNoKey),
+			errors.Is(err, ErrServerHandshakeDuplicateKey),
+			errors.Is(err, ErrServerHandshakeBadKey),
+			errors.Is(err, ErrServerHandshakeBadMethod),
+			errors.Is(err, ErrServerHandshakeBadProto),
+			errors.Is(err, ErrServerHandshakeNoHost),
+			errors.Is(err, ErrServerHandshakeNoUpgrade),
+			errors.Is(err, ErrServerHandshakeNoConnection),
+			errors.Is(err, ErrHTTPBadStartLine),
+			errors.Is(err, ErrHTTPBadHeader):
+			reject.StatusCode = http.StatusBadRequest
+		default:
+			return nil
+		}
+	}
+	if reject.StatusCode == 0 {
+		reject.StatusCode = http.StatusForbidden
+	}
+	if reject.Body == nil {
+		reject.Body = []byte(http.StatusText(reject.StatusCode) + "\n")
+	}
+	return reject
+}
+
+func (ws *WS) writeHTTPResponse(statusCode int, header http.Header, body []byte) error {
+	var response bytes.Buffer
+	response.Grow(1024 + len(body))
+	response.WriteString(fmt.Sprintf("HTTP/1.1 %03d %s\r\n", statusCode, http.StatusText(statusCode)))
+	header = header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	header.Set("Connection", "close")
+	if err := header.Write(&response); err != nil {
+		return err
+	}
+	response.WriteString("\r\n")
+	response.Write(body)
+	return ws.writeEntireBufferRaw(response.Bytes())
+}
+
+func parseHTTPRequest(parser *httpHeadParser) (*WSRequest, error) {
+	method, rest, ok := strings.Cut(parser.startLine, " ")
+	if !ok {
+		return nil, ErrServerHandshakeBadRequest
+	}
+	requestURI, proto, ok := strings.Cut(rest, " ")
+	if !ok || method == "" || requestURI == "" || !isHTTPToken(method) {
+		return nil, ErrServerHandshakeBadRequest
+	}
+	major, minor, ok := http.ParseHTTPVersion(proto)
+	if !ok {
+		return nil, ErrServerHandshakeBadRequest
+	}
+	u, err := url.ParseRequestURI(requestURI)
+	if err != nil {
+		return nil, ErrServerHandshakeBadRequest
+	}
+	return &WSRequest{
+		Method:     method,
+		RequestURI: requestURI,
+		Path:       u.Path,
+		RawQuery:   u.RawQuery,
+		Query:      u.Query(),
+		Proto:      proto,
+		ProtoMajor: major,
+		ProtoMinor: minor,
+		Header:     parser.header,
+	}, nil
+}
+
+func parseHTTPResponse(parser *httpHeadParser) (*HandshakeResponseError, error) {
+	// RFC 7230 - Section 3.1.2:
+	// > status-line = HTTP-version SP status-code SP reason-phrase CRLF
+	proto, status, ok := strings.Cut(parser.startLine, " ")
+	if !ok {
+		return nil, ErrClientHandshakeBadResponse
+	}
+	if _, _, ok := http.ParseHTTPVersion(proto); !ok {
+		return nil, ErrClientHandshakeBadResponse
+	}
+	code, _, _ := strings.Cut(status, " ")
+	if len(code) != 3 {
+		return nil, ErrClientHandshakeBadResponse
+	}
+	statusCode, err := strconv.Atoi(code)
+	if err != nil || statusCode < 100 {
+		return nil, ErrClientHandshakeBadResponse
+	}
+	return &HandshakeResponseError{
+		StatusCode: statusCode,
+		Status:     status,
+		Proto:      proto,
+		Header:     parser.header,
+	}, nil
+}
+
+// readHTTPBody reads at most maxBytes of the body of a response that is not going to be upgraded.
+// Only bodies delimited by Content-Length or by closing the connection are supported.
+func (ws *WS) readHTTPBody(header http.Header, maxBytes int) ([]byte, error) {
+	if contentLength := header.Get("Content-Length"); contentLength != "" {
+		length, err := strconv.Atoi(contentLength)
+		if err != nil || length < 0 {
+			return nil, ErrHTTPBadHeader
+		}
+		body := make([]byte, min(length, maxBytes))
+		if err := ws.readEntireBufferRaw(body); err != nil {
+			return nil, err
+		}
+		return body, nil
+	}
+	if !headerContainsToken(header, "Connection", "close") || header.Get("Transfer-Encoding") != "" {
+		return nil, nil
+	}
+	body := make([]byte, 0, chunkSize)
+	for len(body) < maxBytes {
+		if len(body) == cap(body) {
+			body = append(body, 0)[:len(body)]
+		}
+		n, err := ws.bufferedReader().Read(body[len(body):min(cap(body), maxBytes)])
+		body = body[:len(body)+n]
+		if errors.Is(err, io.EOF) || (err == nil && n == 0) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+// headerTokens returns the tokens of the comma separated list of header key that may be split across several fields
+func headerTokens(header http.Header, key string) []string {
+	var tokens []string
+	for _, value := range header.Values(key) {
+		for _, t := range strings.Split(value, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tokens = append(tokens, t)
+			}
+		}
+	}
+	return tokens
+}
+
+// headerContainsToken reports whether the comma separated list of tokens of header key contains token.
+// The header may be split across several fields.
+func headerContainsToken(header http.Header, key, token string) bool {
+	for _, t := range headerTokens(header, key) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// RFC 7230 - Section 3.2.6:
+// > token          = 1*tchar
+// > tchar          = "!" / "#" / "$" / "%" / "&" / "'" / "*"
+// >                / "+" / "-" / "." / "^" / "_" / "`" / "|" / "~"
+// >                / DIGIT / ALPHA
+func isHTTPToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+			continue
+		}
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", rune(c)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,158 @@
+package wsoding
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// feedHead feeds data to the parser in chunks of the given size until the head is complete
+func feedHead(p *httpHeadParser, data []byte, chunk int) (int, error) {
+	consumed := 0
+	for consumed < len(data) && !p.done {
+		end := min(consumed+chunk, len(data))
+		n, err := p.feed(data[consumed:end])
+		consumed += n
+		if err != nil {
+			return consumed, err
+		}
+	}
+	return consumed, nil
+}
+
+func TestHTTPHeadParser(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		maxBytes  int
+		startLine string
+		header    http.Header
+		consumed  int // Length of the head, defaults to the whole input
+		err       error
+	}{
+		{
+			name:      "crlf",
+			input:     "GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\n\r\n",
+			startLine: "GET / HTTP/1.1",
+			header:    http.Header{"Host": {"example.com"}, "Upgrade": {"websocket"}},
+		},
+		{
+			name:      "lf only",
+			input:     "GET / HTTP/1.1\nHost: example.com\nUpgrade: websocket\n\n",
+			startLine: "GET / HTTP/1.1",
+			header:    http.Header{"Host": {"example.com"}, "Upgrade": {"websocket"}},
+		},
+		{
+			name:      "mixed line endings",
+			input:     "GET / HTTP/1.1\r\nHost: example.com\n\r\n",
+			startLine: "GET / HTTP/1.1",
+			header:    http.Header{"Host": {"example.com"}},
+		},
+		{
+			name:      "data after the head",
+			input:     "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n\x81\x02hi",
+			startLine: "HTTP/1.1 101 Switching Protocols",
+			header:    http.Header{"Upgrade": {"websocket"}},
+			consumed:  len("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n"),
+		},
+		{
+			name:      "leading empty line",
+			input:     "\r\nGET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			startLine: "GET / HTTP/1.1",
+			header:    http.Header{"Host": {"example.com"}},
+		},
+		{
+			name:  "two leading empty lines",
+			input: "\r\n\r\nGET / HTTP/1.1\r\n\r\n",
+			err:   ErrHTTPBadStartLine,
+		},
+		{
+			name:      "folded line",
+			input:     "GET / HTTP/1.1\r\nX-Long: first\r\n  second\r\n\tthird\r\n\r\n",
+			startLine: "GET / HTTP/1.1",
+			header:    http.Header{"X-Long": {"first second third"}},
+		},
+		{
+			name:  "folded line without a header",
+			input: "GET / HTTP/1.1\r\n folded\r\n\r\n",
+			err:   ErrHTTPBadHeader,
+		},
+		{
+			name:      "duplicate headers",
+			input:     "GET / HTTP/1.1\r\nSec-WebSocket-Protocol: chat\r\nsec-websocket-protocol: superchat\r\n\r\n",
+			startLine: "GET / HTTP/1.1",
+			header:    http.Header{"Sec-Websocket-Protocol": {"chat", "superchat"}},
+		},
+		{
+			name:      "multi-valued header",
+			input:     "GET / HTTP/1.1\r\nConnection: keep-alive, Upgrade\r\n\r\n",
+			startLine: "GET / HTTP/1.1",
+			header:    http.Header{"Connection": {"keep-alive, Upgrade"}},
+		},
+		{
+			name:      "whitespace around the value",
+			input:     "GET / HTTP/1.1\r\nHost: \t example.com \t\r\nEmpty:\r\n\r\n",
+			startLine: "GET / HTTP/1.1",
+			header:    http.Header{"Host": {"example.com"}, "Empty": {""}},
+		},
+		{
+			name:  "whitespace before the colon",
+			input: "GET / HTTP/1.1\r\nHost : example.com\r\n\r\n",
+			err:   ErrHTTPBadHeader,
+		},
+		{
+			name:  "missing colon",
+			input: "GET / HTTP/1.1\r\nHost\r\n\r\n",
+			err:   ErrHTTPBadHeader,
+		},
+		{
+			name:      "exactly at the limit",
+			input:     "GET / HTTP/1.1\r\nHost: a\r\n\r\n",
+			maxBytes:  len("GET / HTTP/1.1\r\nHost: a\r\n\r\n"),
+			startLine: "GET / HTTP/1.1",
+			header:    http.Header{"Host": {"a"}},
+		},
+		{
+			name:     "limit crossed in the middle of a line",
+			input:    "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			maxBytes: len("GET / HTTP/1.1\r\nHost: exa"),
+			err:      ErrHeaderTooLarge,
+		},
+		{
+			name:     "limit crossed by the final empty line",
+			input:    "GET / HTTP/1.1\r\nHost: a\r\n\r\n",
+			maxBytes: len("GET / HTTP/1.1\r\nHost: a\r\n\r"),
+			err:      ErrHeaderTooLarge,
+		},
+	}
+	for _, tc := range tests {
+		for _, chunk := range []int{1, 3, len(tc.input)} {
+			p := newHTTPHeadParser(tc.maxBytes)
+			consumed, err := feedHead(p, []byte(tc.input), chunk)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Errorf("%s, chunks of %d: err = %v, want %v", tc.name, chunk, err, tc.err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s, chunks of %d: unexpected error %v", tc.name, chunk, err)
+				continue
+			}
+			want := tc.consumed
+			if want == 0 {
+				want = len(tc.input)
+			}
+			if !p.done || consumed != want {
+				t.Errorf("%s, chunks of %d: done = %v, consumed = %d, want true, %d", tc.name, chunk, p.done, consumed, want)
+			}
+			if p.startLine != tc.startLine {
+				t.Errorf("%s, chunks of %d: start line = %q, want %q", tc.name, chunk, p.startLine, tc.startLine)
+			}
+			if !reflect.DeepEqual(p.header, tc.header) {
+				t.Errorf("%s, chunks of %d: header = %v, want %v", tc.name, chunk, p.header, tc.header)
+			}
+		}
+	}
+}
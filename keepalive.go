@@ -0,0 +1,166 @@
+package wsoding
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// Keepalive sends a PING every interval and fails the connection with 1011 Internal Error when the PONG
+// does not arrive within timeout, which defaults to interval. This way the peers that disappeared without
+// closing the connection are noticed. PONGs are only received while the connection is being read, so
+// the application has to keep reading. Keepalive stops when the returned function is called or the
+// connection is closed. An interval that is not positive disables Keepalive, the returned function does nothing then.
+func (ws *WS) Keepalive(interval, timeout time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+	if timeout <= 0 {
+		timeout = interval
+	}
+	stopped := make(chan struct{})
+	go ws.keepalive(interval, timeout, stopped)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stopped)
+		})
+	}
+}
+
+func (ws *WS) keepalive(interval, timeout time.Duration, stopped chan struct{}) {
+	ticker := time.NewTicker(min(interval, timeout))
+	defer ticker.Stop()
+	lastPing := time.Now()
+	for {
+		select {
+		case <-stopped:
+			return
+		case <-ws.doneChan():
+			return
+		case now := <-ticker.C:
+			if sent, ok := ws.oldestPing(); ok && now.Sub(sent) >= timeout {
+				ws.dropDeadPeer(timeout)
+				return
+			}
+			if now.Sub(lastPing) < interval {
+				continue
+			}
+			lastPing = now
+			if err := ws.sendPing(ws.nextPingPayload()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// dropDeadPeer fails the connection and destroys the socket without waiting for the peer, which is gone
+func (ws *WS) dropDeadPeer(timeout time.Duration) {
+	// The send buffer of a dead connection may be full, the CLOSE is not worth waiting for longer than a PONG
+	ws.Sock.SetWriteDeadline(time.Now().Add(timeout))
+	ws.failConnection(CloseInternalError, ErrPongTimeout)
+	ws.pingMu.Lock()
+	ws.peerDead = true
+	ws.pingMu.Unlock()
+	ws.closeOnce.Do(func() {
+		close(ws.doneChan())
+	})
+	ws.Sock.Close()
+}
+
+// Ping sends PING with payload of at most 125 bytes. The PONG answering it is matched by the payload,
+// reported to OnPong with the round trip time and updates RTT. PONGs are only received while the
+// connection is being read.
+func (ws *WS) Ping(payload []byte) error {
+	// RFC 6455 - Section 5.5:
+	// > All control frames MUST have a payload length of 125 bytes or less
+	if len(payload) > 125 {
+		return ErrControlFrameTooBig
+	}
+	return ws.sendPing(payload)
+}
+
+func (ws *WS) nextPingPayload() []byte {
+	ws.pingMu.Lock()
+	defer ws.pingMu.Unlock()
+	ws.pingSeq++
+	return binary.BigEndian.AppendUint64(nil, ws.pingSeq)
+}
+
+// sendPing sends PING and remembers when, so the PONG answering it measures the round trip time
+func (ws *WS) sendPing(payload []byte) error {
+	ws.pingMu.Lock()
+	if ws.pings == nil {
+		ws.pings = make(map[string]time.Time)
+	}
+	ws.pings[string(payload)] = time.Now()
+	ws.pingMu.Unlock()
+	if err := ws.SendFrame(true, OpCodePING, payload); err != nil {
+		ws.pingMu.Lock()
+		delete(ws.pings, string(payload))
+		ws.pingMu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// receivePong matches the PONG to its PING by the payload. It returns the round trip time,
+// false if the PONG does not answer any outstanding PING.
+//
+// RFC 6455 - Section 5.5.3:
+// > If an endpoint receives a Ping frame and has not yet sent Pong
+// > frame(s) in response to previous Ping frame(s), the endpoint MAY
+// > elect to send a Pong frame for only the most recently processed Ping
+// > frame.
+// So a PONG answers the PINGs sent before its PING as well.
+func (ws *WS) receivePong(payload []byte) (time.Duration, bool) {
+	ws.pingMu.Lock()
+	defer ws.pingMu.Unlock()
+	sent, ok := ws.pings[string(payload)]
+	if !ok {
+		return 0, false
+	}
+	for key, at := range ws.pings {
+		if !at.After(sent) {
+			delete(ws.pings, key)
+		}
+	}
+	ws.rtt = time.Since(sent)
+	return ws.rtt, true
+}
+
+// peerDeadError replaces the error of the socket destroyed by the keepalive with ErrPongTimeout
+func (ws *WS) peerDeadError(err error) error {
+	ws.pingMu.Lock()
+	defer ws.pingMu.Unlock()
+	if err != nil && ws.peerDead {
+		return ErrPongTimeout
+	}
+	return err
+}
+
+func (ws *WS) oldestPing() (time.Time, bool) {
+	ws.pingMu.Lock()
+	defer ws.pingMu.Unlock()
+	var oldest time.Time
+	for _, at := range ws.pings {
+		if oldest.IsZero() || at.Before(oldest) {
+			oldest = at
+		}
+	}
+	return oldest, !oldest.IsZero()
+}
+
+// RTT returns the round trip time measured by the last PING answered by the peer, zero if none was
+func (ws *WS) RTT() time.Duration {
+	ws.pingMu.Lock()
+	defer ws.pingMu.Unlock()
+	return ws.rtt
+}
+
+func (ws *WS) doneChan() chan struct{} {
+	ws.doneOnce.Do(func() {
+		ws.done = make(chan struct{})
+	})
+	return ws.done
+}
@@ -0,0 +1,55 @@
+package wsoding
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestKeepaliveDisabled(t *testing.T) {
+	ws := &WS{Sock: &testTransport{}}
+	// Starting a ticker with a zero period would panic
+	stop := ws.Keepalive(0, time.Second)
+	stop()
+	ws.Keepalive(-time.Second, 0)()
+	// The ticker would be started by the goroutine of Keepalive, give it the time to crash
+	time.Sleep(20 * time.Millisecond)
+}
+
+func TestKeepalivePongTimeout(t *testing.T) {
+	client, server := pipePair(t, nil, nil)
+	// The server reads what the client sends but never answers the PINGs
+	received := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(server.Sock)
+		received <- data
+	}()
+	client.Keepalive(20*time.Millisecond, 50*time.Millisecond)
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.ReadMessage()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrPongTimeout) {
+			t.Fatalf("err = %v, want %v", err, ErrPongTimeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the dead peer has not been noticed")
+	}
+	data := <-received
+	for len(data) >= 2 {
+		// The control frames of the client are short and masked
+		end := min(2+4+int(data[1]&0x7f), len(data))
+		if WSOpcode(data[0]&0x0f) == OpCodeCLOSE {
+			if code := sentCloseCode(t, data[:end]); code != CloseInternalError {
+				t.Fatalf("sent CLOSE %d, want %d", code, CloseInternalError)
+			}
+			return
+		}
+		data = data[end:]
+	}
+	t.Fatal("no CLOSE has been sent")
+}
@@ -0,0 +1,50 @@
+package wsoding
+
+import (
+	"encoding/binary"
+	"unsafe"
+)
+
+// maskBytes applies the mask to b, which starts at the offset pos of the payload.
+// The bulk of b is XORed a word at a time with the mask repeated twice, only the unaligned
+// head and the tail shorter than a word go byte by byte.
+//
+// RFC 6455 - Section 5.3:
+// > Octet i of the transformed data ("transformed-octet-i") is the XOR of
+// > octet i of the original data ("original-octet-i") with octet at index
+// > i modulo 4 of the masking key ("masking-key-octet-j"):
+// >
+// >   j                   = i MOD 4
+// >   transformed-octet-i = original-octet-i XOR masking-key-octet-j
+func maskBytes(mask [4]byte, pos int, b []byte) {
+	pos &= 3
+	if len(b) >= 16 {
+		head := int(-uintptr(unsafe.Pointer(&b[0])) & 7)
+		for i := range head {
+			b[i] ^= mask[(pos+i)&3]
+		}
+		b = b[head:]
+		pos = (pos + head) & 3
+		// The key starts with the byte of the mask that lands on b[0]
+		var key [8]byte
+		for i := range key {
+			key[i] = mask[(pos+i)&3]
+		}
+		word := binary.LittleEndian.Uint64(key[:])
+		for len(b) >= 32 {
+			binary.LittleEndian.PutUint64(b[0:], binary.LittleEndian.Uint64(b[0:])^word)
+			binary.LittleEndian.PutUint64(b[8:], binary.LittleEndian.Uint64(b[8:])^word)
+			binary.LittleEndian.PutUint64(b[16:], binary.LittleEndian.Uint64(b[16:])^word)
+			binary.LittleEndian.PutUint64(b[24:], binary.LittleEndian.Uint64(b[24:])^word)
+			b = b[32:]
+		}
+		for len(b) >= 8 {
+			binary.LittleEndian.PutUint64(b, binary.LittleEndian.Uint64(b)^word)
+			b = b[8:]
+		}
+		// Whole words keep the position in the mask where it was
+	}
+	for i := range b {
+		b[i] ^= mask[(pos+i)&3]
+	}
+}
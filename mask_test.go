@@ -0,0 +1,76 @@
+package wsoding
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func maskBytesNaive(mask [4]byte, pos int, b []byte) {
+	for i := range b {
+		b[i] ^= mask[(pos+i)%4]
+	}
+}
+
+func TestMaskBytesMatchesNaive(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	buffer := make([]byte, 4096)
+	for range 20000 {
+		offset := r.Intn(16)
+		length := r.Intn(128)
+		if r.Intn(10) == 0 {
+			length = r.Intn(len(buffer) - offset)
+		}
+		pos := r.Intn(1 << 20)
+		var mask [4]byte
+		r.Read(mask[:])
+		r.Read(buffer)
+		got := bytes.Clone(buffer)
+		want := bytes.Clone(buffer)
+		maskBytes(mask, pos, got[offset:offset+length])
+		maskBytesNaive(mask, pos, want[offset:offset+length])
+		// Comparing the whole buffer also catches writes outside of the slice
+		if !bytes.Equal(got, want) {
+			t.Fatalf("offset %d, length %d, pos %d, mask %x: masked bytes differ", offset, length, pos, mask)
+		}
+	}
+}
+
+func TestMaskBytesInChunks(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	payload := make([]byte, 1000)
+	r.Read(payload)
+	mask := [4]byte{0x37, 0xfa, 0x21, 0x3d}
+	want := bytes.Clone(payload)
+	maskBytesNaive(mask, 0, want)
+	// Short reads unmask the payload piece by piece
+	got := bytes.Clone(payload)
+	for pos := 0; pos < len(got); {
+		n := min(1+r.Intn(40), len(got)-pos)
+		maskBytes(mask, pos, got[pos:pos+n])
+		pos += n
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("masking in chunks differs from masking at once")
+	}
+}
+
+func BenchmarkMaskBytes(b *testing.B) {
+	mask := [4]byte{0x37, 0xfa, 0x21, 0x3d}
+	for _, size := range []int{16, 125, 1024, 64 * 1024, 1 << 20} {
+		payload := make([]byte, size+1)[1:] // Unaligned
+		b.Run(fmt.Sprintf("word/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for range b.N {
+				maskBytes(mask, 1, payload)
+			}
+		})
+		b.Run(fmt.Sprintf("naive/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for range b.N {
+				maskBytesNaive(mask, 1, payload)
+			}
+		})
+	}
+}
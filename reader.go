@@ -0,0 +1,256 @@
+package wsoding
+
+import (
+	"errors"
+	"io"
+)
+
+// incomingMessage is the data message NextReader has returned the reader of. The readers are reused
+// from one message to another.
+type incomingMessage struct {
+	active  bool
+	frames  messageReader
+	limit   limitReader
+	utf8    utf8Reader
+	payload io.Reader // The frames after the extensions and the UTF-8 verification
+}
+
+// NextReader waits for the next data message and returns its kind and the reader of its payload.
+// The payload is streamed from the socket across the CONT frames as it is read, so the message is
+// never held in memory. PINGs, PONGs and CLOSE that arrive in the middle are handled on the way.
+// The reader is only valid until the next call to NextReader, which discards whatever is left unread.
+func (ws *WS) NextReader() (WSMessageKind, io.Reader, error) {
+	if ws.readErr != nil {
+		return 0, nil, ws.readErr
+	}
+	message := &ws.message
+	if message.active {
+		message.active = false
+		// The next frame header is wherever the discarding stopped, so a failure breaks reading for good
+		if _, err := io.Copy(io.Discard, message.payload); err != nil {
+			ws.readErr = err
+			return 0, nil, err
+		}
+		// The extensions may stop reading before the end of the last frame
+		if _, err := io.Copy(io.Discard, &message.frames); err != nil {
+			ws.readErr = err
+			return 0, nil, err
+		}
+	}
+	frame, err := ws.nextDataFrame()
+	if err != nil {
+		return 0, nil, err
+	}
+	var kind WSMessageKind
+	switch frame.opcode {
+	case OpCodeTEXT, OpCodeBIN:
+		kind = WSMessageKind(frame.opcode)
+	default:
+		// The payload of the frame is left unread, nothing that follows can be parsed anymore
+		return 0, nil, ws.failReading(CloseProtocolError, ErrUnexpectedOpCode)
+	}
+	frames := &message.frames
+	*frames = messageReader{ws: ws, frame: frame}
+	var payload io.Reader = frames
+	if len(ws.extensions) > 0 {
+		payload = ws.decodeMessage(kind, frame.rsv(), payload)
+		// The size of the message is only known after the extensions, which may inflate it a lot
+		if ws.MaxMessageSize > 0 {
+			message.limit = limitReader{ws: ws, r: payload, remaining: ws.MaxMessageSize}
+			payload = &message.limit
+		}
+	} else {
+		// Without the extensions the frames are the message, so a frame that is too big fails before it is read
+		frames.limit = ws.MaxMessageSize
+	}
+	if err := frames.checkLimit(); err != nil {
+		return 0, nil, err
+	}
+	// The payload is only meaningful after it went through the extensions
+	if kind == MessageTEXT {
+		message.utf8 = utf8Reader{ws: ws, r: payload}
+		payload = &message.utf8
+	}
+	message.payload = payload
+	message.active = true
+	return kind, payload, nil
+}
+
+// nextDataFrame reads the frames until a data one, handling the control frames on the way
+func (ws *WS) nextDataFrame() (WSFrameHeader, error) {
+	for {
+		// Giving up before the next frame has started arriving leaves the connection usable,
+		// so an expired deadline or a cancelled context can be retried
+		if _, err := ws.bufferedReader().Peek(1); err != nil {
+			return WSFrameHeader{}, ws.peerDeadError(err)
+		}
+		frame, err := ws.readFrameHeader()
+		if err == nil && frame.opcode.isControl() {
+			err = ws.handleControlFrame(frame)
+			if err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			ws.readErr = ws.peerDeadError(err)
+			return WSFrameHeader{}, ws.readErr
+		}
+		return frame, nil
+	}
+}
+
+func (ws *WS) handleControlFrame(frame WSFrameHeader) error {
+	payload, err := ws.readControlPayload(frame)
+	if err != nil {
+		return err
+	}
+	switch frame.opcode {
+	case OpCodeCLOSE:
+		return ws.receiveClose(payload)
+	case OpCodePING:
+		// RFC 6455 - Section 5.5.2:
+		// > Upon receipt of a Ping frame, an endpoint MUST send a Pong frame in
+		// > response, unless it already received a Close frame.
+		err := ws.SendFrame(true, OpCodePONG, payload)
+		// Nothing is sent after our CLOSE, the peer is about to close anyway
+		if err != nil && !errors.Is(err, ErrCloseSent) {
+			return err
+		}
+		if ws.OnPing != nil {
+			ws.OnPing(payload)
+		}
+		return nil
+	case OpCodePONG:
+		// The PONGs answering our PINGs measure the round trip time, unsolicited ones are just ignored
+		rtt, _ := ws.receivePong(payload)
+		if ws.OnPong != nil {
+			ws.OnPong(payload, rtt)
+		}
+		return nil
+	default:
+		return ErrUnexpectedOpCode
+	}
+}
+
+// messageReader reads the payload of a data message frame by frame
+type messageReader struct {
+	ws    *WS
+	frame WSFrameHeader
+	pos   int // Bytes of the payload of frame already read
+	total int // Payload of the frames before frame
+	limit int // MaxMessageSize if the frames are not transformed by the extensions
+	err   error
+}
+
+func (r *messageReader) checkLimit() error {
+	if r.limit > 0 && r.total+r.frame.payloadLen > r.limit {
+		r.err = r.ws.failReading(CloseMessageTooBig, ErrMessageTooBig)
+		return r.err
+	}
+	return nil
+}
+
+func (r *messageReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	for r.pos == r.frame.payloadLen {
+		if r.frame.fin {
+			r.err = io.EOF
+			return 0, r.err
+		}
+		frame, err := r.ws.nextDataFrame()
+		if err == nil && frame.opcode != OpCodeCONT {
+			err = r.ws.failReading(CloseProtocolError, ErrUnexpectedOpCode)
+		}
+		if err != nil {
+			// Even a timeout before the next fragment leaves the message halfway
+			r.ws.readErr = err
+			r.err = err
+			return 0, err
+		}
+		r.total += r.frame.payloadLen
+		r.frame = frame
+		r.pos = 0
+		if err := r.checkLimit(); err != nil {
+			return 0, err
+		}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if remaining := r.frame.payloadLen - r.pos; len(p) > remaining {
+		p = p[:remaining]
+	}
+	n, err := r.ws.bufferedReader().Read(p)
+	if r.frame.masked {
+		maskBytes(r.frame.mask, r.pos, p[:n])
+	}
+	r.pos += n
+	if err != nil {
+		// The connection must not end in the middle of a frame
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		err = r.ws.peerDeadError(err)
+		r.ws.readErr = err
+		r.err = err
+	}
+	return n, err
+}
+
+// limitReader fails a message that has been inflated by the extensions beyond MaxMessageSize
+type limitReader struct {
+	ws        *WS
+	r         io.Reader
+	remaining int
+	err       error
+}
+
+func (r *limitReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	// Reading one byte over the limit tells a message that is too big from one that fits exactly
+	if len(p) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.r.Read(p)
+	if n > r.remaining {
+		r.err = r.ws.failReading(CloseMessageTooBig, ErrMessageTooBig)
+		return 0, r.err
+	}
+	r.remaining -= n
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// utf8Reader fails a text message as soon as its payload stops being valid UTF-8
+type utf8Reader struct {
+	ws        *WS
+	r         io.Reader
+	validator utf8Validator
+	err       error
+}
+
+func (r *utf8Reader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.r.Read(p)
+	verifyErr := r.validator.feed(p[:n])
+	if verifyErr == nil && errors.Is(err, io.EOF) {
+		verifyErr = r.validator.finish()
+	}
+	if verifyErr != nil {
+		// The RFC requires failing the connection, see utf8Validator
+		r.err = r.ws.failReading(CloseInvalidPayload, verifyErr)
+		return 0, r.err
+	}
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
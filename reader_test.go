@@ -0,0 +1,102 @@
+package wsoding
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// sentCloseCode unmasks the CLOSE a client has written and returns its status code
+func sentCloseCode(t *testing.T, output []byte) WSCloseCode {
+	t.Helper()
+	if len(output) < 8 || output[0] != 0x80|byte(OpCodeCLOSE) || output[1]&0x7f < 2 {
+		t.Fatalf("no CLOSE with a status code in % x", output)
+	}
+	var mask [4]byte
+	copy(mask[:], output[2:6])
+	payload := bytes.Clone(output[6:8])
+	maskBytes(mask, 0, payload)
+	return WSCloseCode(binary.BigEndian.Uint16(payload))
+}
+
+func TestReadLimits(t *testing.T) {
+	tests := []struct {
+		name           string
+		frames         []byte
+		maxFrameSize   int
+		maxMessageSize int
+		deflate        bool
+		err            error
+	}{
+		{
+			name:         "frame over MaxFrameSize",
+			frames:       []byte{0x82, 0x05, 'a', 'b', 'c', 'd', 'e', 0x82, 0x01, 'f'},
+			maxFrameSize: 4,
+			err:          ErrFrameTooBig,
+		},
+		{
+			name:           "first frame over MaxMessageSize",
+			frames:         []byte{0x82, 0x05, 'a', 'b', 'c', 'd', 'e', 0x82, 0x01, 'f'},
+			maxMessageSize: 4,
+			err:            ErrMessageTooBig,
+		},
+		{
+			name:           "fragments over MaxMessageSize",
+			frames:         []byte{0x02, 0x03, 'a', 'b', 'c', 0x80, 0x03, 'd', 'e', 'f', 0x82, 0x01, 'g'},
+			maxMessageSize: 4,
+			err:            ErrMessageTooBig,
+		},
+		{
+			name:           "message inflated over MaxMessageSize",
+			frames:         []byte{0xc1, 0x07, 0xf2, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00, 0x81, 0x01, 'g'},
+			maxMessageSize: 4,
+			deflate:        true,
+			err:            ErrMessageTooBig,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			transport := &testTransport{input: bytes.NewReader(tc.frames)}
+			ws := &WS{
+				Sock:           transport,
+				Client:         true,
+				MaxFrameSize:   tc.maxFrameSize,
+				MaxMessageSize: tc.maxMessageSize,
+			}
+			if tc.deflate {
+				ws.extensions = []NegotiatedExtension{newDeflateExtension(&PerMessageDeflate{}, false, false, 0)}
+			}
+			// The frames that follow are never mistaken for a message
+			for range 2 {
+				if _, err := ws.ReadMessage(); !errors.Is(err, tc.err) {
+					t.Fatalf("err = %v, want %v", err, tc.err)
+				}
+			}
+			if code := sentCloseCode(t, transport.output.Bytes()); code != CloseMessageTooBig {
+				t.Fatalf("sent CLOSE %d, want %d", code, CloseMessageTooBig)
+			}
+		})
+	}
+}
+
+func TestReadTimeoutInTheMiddleOfAFrame(t *testing.T) {
+	client, server := pipePair(t, nil, nil)
+	// 10 bytes announced, 3 delivered
+	go server.Sock.Write([]byte{0x82, 0x0a, 'a', 'b', 'c'})
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := client.ReadMessage()
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("err = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	// The rest of the frame and a whole message arrive, but the frame boundary has been lost
+	client.SetReadDeadline(time.Time{})
+	go server.Sock.Write([]byte{'d', 'e', 'f', 'g', 'h', 'i', 'j', 0x82, 0x02, 'h', 'i'})
+	for range 3 {
+		if message, err := client.ReadMessage(); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("retry: message %v, err = %v, want %v", message, err, os.ErrDeadlineExceeded)
+		}
+	}
+}
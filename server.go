@@ -0,0 +1,381 @@
+package wsoding
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mdlayher/socket"
+	"golang.org/x/sys/unix"
+)
+
+const defaultHandshakeTimeout = 10 * time.Second
+
+// Server accepts WebSocket connections on a listening socket and runs Handler for each of them.
+// The handshakes are performed concurrently, so a slow client does not hold up the others.
+type Server struct {
+	// Handler serves a single connection, the socket is closed when it returns
+	Handler func(ws *WS)
+	// AcceptOptions of the server handshake, may be nil
+	AcceptOptions *AcceptOptions
+	// TLSConfig turns the server into a wss:// one
+	TLSConfig *tls.Config
+	// HandshakeTimeout limits the TLS and the WebSocket handshakes of a connection, defaults to 10 seconds
+	HandshakeTimeout time.Duration
+	// MaxConns limits the number of connections handled at once, including the ones still in the handshake.
+	// The following connections wait in the backlog of the socket. No limit if zero.
+	MaxConns int
+	// PingInterval turns on the keepalive of every connection, see WS.Keepalive. PongTimeout defaults to it.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	// OnHandshakeError is called with the error of every failed handshake, the errors are dropped if nil
+	OnHandshakeError func(err error)
+
+	mu       sync.Mutex
+	listener *socket.Conn
+	unixPath string
+	ctx      context.Context // Cancelled when the server is closed, interrupts the handshakes
+	cancel   context.CancelFunc
+	closed   bool
+	conns    map[*socket.Conn]*WS // The connection is nil while it is in the handshake
+	handlers sync.WaitGroup
+}
+
+// ListenAndServe listens on address and serves the connections until the server is shut down
+func (s *Server) ListenAndServe(network, address string) error {
+	if err := s.Listen(network, address); err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+// Listen binds the listening socket. The network is "tcp", "tcp4", "tcp6" or "unix".
+// For "tcp" an empty host listens on both IPv4 and IPv6, and the port 0 picks a free one, see Addr.
+func (s *Server) Listen(network, address string) error {
+	family, sa, err := listenSockaddr(network, address)
+	if err != nil {
+		return err
+	}
+	listener, err := socket.Socket(family, syscall.SOCK_STREAM, 0, "wsoding-server", nil)
+	if err != nil {
+		return err
+	}
+	if family != syscall.AF_UNIX {
+		if err := listener.SetsockoptInt(syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+	if family == syscall.AF_INET6 {
+		v6only := 0
+		if network == "tcp6" {
+			v6only = 1
+		}
+		if err := listener.SetsockoptInt(syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, v6only); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+	if err := listener.Bind(sa); err != nil {
+		listener.Close()
+		return err
+	}
+	if err := listener.Listen(unix.SOMAXCONN); err != nil {
+		listener.Close()
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		listener.Close()
+		return ErrServerClosed
+	}
+	if s.listener != nil {
+		listener.Close()
+		return ErrServerListening
+	}
+	s.listener = listener
+	if family == syscall.AF_UNIX {
+		s.unixPath = address
+	}
+	return nil
+}
+
+// Addr returns the address the server listens on, nil if it does not
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	listener := s.listener
+	s.mu.Unlock()
+	if listener == nil {
+		return nil
+	}
+	return socketConn{listener}.LocalAddr()
+}
+
+// Serve accepts the connections on the socket bound by Listen until the server is shut down.
+// It always returns an error, ErrServerClosed after Shutdown or Close.
+func (s *Server) Serve() error {
+	s.mu.Lock()
+	listener := s.listener
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	if listener == nil {
+		s.mu.Unlock()
+		return ErrServerNotListening
+	}
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	ctx := s.ctx
+	s.mu.Unlock()
+
+	var slots chan struct{}
+	if s.MaxConns > 0 {
+		slots = make(chan struct{}, s.MaxConns)
+	}
+	var backoff time.Duration
+	for {
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return ErrServerClosed
+			}
+		}
+		sock, _, err := listener.Accept(ctx, 0)
+		if err != nil {
+			if slots != nil {
+				<-slots
+			}
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if !isTemporaryAcceptError(err) {
+				return err
+			}
+			// Running out of file descriptors or memory goes away once some connections are closed
+			backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		if !s.track(sock, nil) {
+			sock.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			s.serveConn(ctx, sock)
+			if slots != nil {
+				<-slots
+			}
+		}()
+	}
+}
+
+func (s *Server) serveConn(ctx context.Context, sock *socket.Conn) {
+	defer s.handlers.Done()
+	defer s.untrack(sock)
+	defer sock.Close()
+	timeout := s.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	handshakeCtx, cancel := context.WithTimeout(ctx, timeout)
+	var ws *WS
+	var err error
+	if s.TLSConfig != nil {
+		ws, err = AcceptTLS(handshakeCtx, sock, s.TLSConfig, s.AcceptOptions)
+	} else {
+		ws, err = Accept(handshakeCtx, sock, s.AcceptOptions)
+	}
+	cancel()
+	if err != nil {
+		if s.OnHandshakeError != nil {
+			s.OnHandshakeError(err)
+		}
+		return
+	}
+	// The server may have started shutting down while the handshake was going on
+	if !s.track(sock, ws) {
+		ws.sendClose(CloseGoingAway, "")
+		return
+	}
+	if s.PingInterval > 0 {
+		ws.Keepalive(s.PingInterval, s.PongTimeout)
+	}
+	if s.Handler != nil {
+		s.Handler(ws)
+	}
+	// Letting the CLOSE the handler may have left behind reach the peer before the socket is destroyed
+	ws.Sock.SetReadDeadline(time.Now().Add(ws.closeTimeout()))
+	ws.Close()
+}
+
+// Shutdown gracefully stops the server: it stops accepting connections, sends CLOSE with 1001 Going Away
+// to every open connection and waits for their handlers to return. When ctx is done before that,
+// the remaining connections are closed abruptly and the error of ctx is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	live := s.stop()
+	for _, ws := range live {
+		// A peer that does not read would block the CLOSE and with it the shutdown of the others
+		go ws.sendClose(CloseGoingAway, "")
+	}
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.closeConns()
+		return ctx.Err()
+	}
+}
+
+// Close immediately stops the server and closes all of its connections without the closing handshake
+func (s *Server) Close() error {
+	s.stop()
+	s.closeConns()
+	return nil
+}
+
+// stop closes the listener, interrupts the handshakes and returns the established connections
+func (s *Server) stop() []*WS {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		if s.cancel != nil {
+			s.cancel()
+		}
+		if s.listener != nil {
+			s.listener.Close()
+			if s.unixPath != "" {
+				os.Remove(s.unixPath)
+			}
+		}
+	}
+	var live []*WS
+	for _, ws := range s.conns {
+		if ws != nil {
+			live = append(live, ws)
+		}
+	}
+	return live
+}
+
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sock := range s.conns {
+		sock.Close()
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// track registers the connection, ws is nil while the handshake is going on.
+// It returns false if the server has already been closed.
+func (s *Server) track(sock *socket.Conn, ws *WS) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[*socket.Conn]*WS)
+	}
+	if _, ok := s.conns[sock]; !ok {
+		s.handlers.Add(1)
+	}
+	s.conns[sock] = ws
+	return true
+}
+
+func (s *Server) untrack(sock *socket.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, sock)
+}
+
+func listenSockaddr(network, address string) (int, unix.Sockaddr, error) {
+	switch network {
+	case "unix":
+		if address == "" {
+			return 0, nil, ErrServerBadAddress
+		}
+		return syscall.AF_UNIX, &unix.SockaddrUnix{Name: address}, nil
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return 0, nil, ErrServerBadNetwork
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return 0, nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		port, err = net.LookupPort(network, portStr)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	if port < 0 || port > 0xFFFF {
+		return 0, nil, ErrServerBadAddress
+	}
+	var addr netip.Addr
+	switch {
+	case host == "" && network == "tcp4":
+		addr = netip.IPv4Unspecified()
+	case host == "":
+		addr = netip.IPv6Unspecified()
+	default:
+		addr, err = netip.ParseAddr(host)
+		if err != nil {
+			ipNetwork := "ip"
+			switch network {
+			case "tcp4":
+				ipNetwork = "ip4"
+			case "tcp6":
+				ipNetwork = "ip6"
+			}
+			addrs, err := net.DefaultResolver.LookupNetIP(context.Background(), ipNetwork, host)
+			if err != nil {
+				return 0, nil, err
+			}
+			if len(addrs) == 0 {
+				return 0, nil, ErrServerBadAddress
+			}
+			addr = addrs[0]
+		}
+	}
+	if (network == "tcp4" && !addr.Unmap().Is4()) || (network == "tcp6" && addr.Is4()) {
+		return 0, nil, ErrServerBadAddress
+	}
+	family, sa := inetSockaddr(addr, port)
+	return family, sa, nil
+}
+
+func isTemporaryAcceptError(err error) bool {
+	return errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.EMFILE) ||
+		errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ENOBUFS) ||
+		errors.Is(err, syscall.ENOMEM)
+}
@@ -0,0 +1,63 @@
+package wsoding
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestShutdownGoingAway(t *testing.T) {
+	handlerDone := make(chan struct{})
+	server := &Server{
+		Handler: func(ws *WS) {
+			defer close(handlerDone)
+			for {
+				message, err := ws.ReadMessage()
+				if err != nil {
+					break
+				}
+				ws.SendMessage(message.Kind, message.Payload)
+			}
+			// Shutdown has to wait for the handlers that are still cleaning up
+			time.Sleep(50 * time.Millisecond)
+		},
+	}
+	if err := server.Listen("tcp4", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := Dial(ctx, "ws://"+server.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The echo makes sure the handler is running before the shutdown starts
+	if err := client.SendText("hello"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(ctx)
+	}()
+	var closeErr *CloseError
+	if _, err := client.ReadMessage(); !errors.As(err, &closeErr) || closeErr.Code != CloseGoingAway {
+		t.Fatalf("err = %v, want CLOSE %d", err, CloseGoingAway)
+	}
+	// The server waits for the end of our input before destroying the socket
+	if err := client.CloseWithCode(CloseNormalClosure, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-handlerDone:
+	default:
+		t.Fatal("Shutdown returned before the handler")
+	}
+}
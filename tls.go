@@ -0,0 +1,151 @@
+package wsoding
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"slices"
+
+	"github.com/mdlayher/socket"
+	"golang.org/x/sys/unix"
+)
+
+// AcceptTLS terminates TLS on sock with config and performs the server handshake over it.
+// Certificates, SNI, ALPN and client certificate authentication are all configured through config.
+func AcceptTLS(ctx context.Context, sock Transport, config *tls.Config, opts *AcceptOptions) (*WS, error) {
+	conn, err := asNetConn(sock)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Server(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return Accept(ctx, tlsConn, opts)
+}
+
+// TLSConnectionState returns the state of the TLS connection the WebSocket runs over, if any
+func (ws *WS) TLSConnectionState() (tls.ConnectionState, bool) {
+	if conn, ok := ws.Sock.(*tls.Conn); ok {
+		return conn.ConnectionState(), true
+	}
+	return tls.ConnectionState{}, false
+}
+
+// RemoteAddr returns the address of the peer, nil if the transport cannot tell it
+func (ws *WS) RemoteAddr() net.Addr {
+	conn, err := asNetConn(ws.Sock)
+	if err != nil {
+		return nil
+	}
+	return conn.RemoteAddr()
+}
+
+func dialTLS(ctx context.Context, sock Transport, hostname string, opts *DialOptions) (*tls.Conn, error) {
+	conn, err := asNetConn(sock)
+	if err != nil {
+		return nil, err
+	}
+	var config *tls.Config
+	if opts.TLSConfig != nil {
+		config = opts.TLSConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config.ServerName = hostname
+	}
+	// The upgrade request is an HTTP/1.1 one, it must not end up negotiating HTTP/2
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"http/1.1"}
+	}
+	if len(opts.PinnedKeys) > 0 {
+		verifyConnection := config.VerifyConnection
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if verifyConnection != nil {
+				if err := verifyConnection(state); err != nil {
+					return err
+				}
+			}
+			return verifyPinnedKeys(state, opts.PinnedKeys)
+		}
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// verifyPinnedKeys accepts the connection if the public key of any certificate of a verified chain is pinned.
+// The server may send certificates that are not part of any chain, so only the verified chains count,
+// or just the leaf when the verification has been skipped.
+func verifyPinnedKeys(state tls.ConnectionState, pins [][]byte) error {
+	chains := state.VerifiedChains
+	if len(chains) == 0 && len(state.PeerCertificates) > 0 {
+		chains = [][]*x509.Certificate{state.PeerCertificates[:1]}
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			if slices.ContainsFunc(pins, func(pin []byte) bool {
+				return bytes.Equal(pin, digest[:])
+			}) {
+				return nil
+			}
+		}
+	}
+	return ErrTLSKeyNotPinned
+}
+
+// asNetConn makes crypto/tls, which only works on net.Conn, usable with the raw sockets
+func asNetConn(sock Transport) (net.Conn, error) {
+	switch sock := sock.(type) {
+	case net.Conn:
+		return sock, nil
+	case *socket.Conn:
+		return socketConn{sock}, nil
+	default:
+		return nil, ErrTLSUnsupportedTransport
+	}
+}
+
+type socketConn struct {
+	*socket.Conn
+}
+
+func (c socketConn) LocalAddr() net.Addr {
+	sa, err := c.Getsockname()
+	if err != nil {
+		return nil
+	}
+	return sockaddrToAddr(sa)
+}
+
+func (c socketConn) RemoteAddr() net.Addr {
+	sa, err := c.Getpeername()
+	if err != nil {
+		return nil
+	}
+	return sockaddrToAddr(sa)
+}
+
+func sockaddrToAddr(sa unix.Sockaddr) net.Addr {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return &net.TCPAddr{IP: net.IP(sa.Addr[:]), Port: sa.Port}
+	case *unix.SockaddrInet6:
+		addr := &net.TCPAddr{IP: net.IP(sa.Addr[:]), Port: sa.Port}
+		if iface, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
+			addr.Zone = iface.Name
+		}
+		return addr
+	case *unix.SockaddrUnix:
+		return &net.UnixAddr{Name: sa.Name, Net: "unix"}
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,111 @@
+package wsoding
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCertificate creates a certificate signed by parent, or a self-signed one if parent is nil
+func newTestCertificate(t *testing.T, name string, isCA bool, parent *testCertificate) *testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		DNSNames:              []string{name},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{cert: cert, key: key}
+}
+
+func (c *testCertificate) pin() []byte {
+	digest := sha256.Sum256(c.cert.RawSubjectPublicKeyInfo)
+	return digest[:]
+}
+
+func TestPinnedKeys(t *testing.T) {
+	ca := newTestCertificate(t, "ca", true, nil)
+	leaf := newTestCertificate(t, "localhost", false, ca)
+	// A certificate anybody can get a copy of, sent by the server although it is not part of its chain
+	unrelated := newTestCertificate(t, "unrelated", true, nil)
+	chain := tls.Certificate{
+		Certificate: [][]byte{leaf.cert.Raw, unrelated.cert.Raw},
+		PrivateKey:  leaf.key,
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	tests := []struct {
+		name     string
+		insecure bool
+		pin      *testCertificate
+		err      error
+	}{
+		{name: "leaf", pin: leaf},
+		{name: "root of the chain", pin: ca},
+		{name: "certificate outside of the chain", pin: unrelated, err: ErrTLSKeyNotPinned},
+		{name: "leaf without verification", insecure: true, pin: leaf},
+		{name: "root without verification", insecure: true, pin: ca, err: ErrTLSKeyNotPinned},
+		{name: "certificate outside of the chain without verification", insecure: true, pin: unrelated, err: ErrTLSKeyNotPinned},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+			go func() {
+				server := tls.Server(serverConn, &tls.Config{Certificates: []tls.Certificate{chain}})
+				server.Handshake()
+				server.Close()
+			}()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, err := dialTLS(ctx, clientConn, "localhost", &DialOptions{
+				TLSConfig:  &tls.Config{RootCAs: roots, InsecureSkipVerify: tc.insecure},
+				PinnedKeys: [][]byte{tc.pin.pin()},
+			})
+			if tc.err == nil && err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if tc.err != nil && !errors.Is(err, tc.err) {
+				t.Fatalf("err = %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package wsoding
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/mdlayher/socket"
+	"golang.org/x/sys/unix"
+)
+
+// Transport is the reliable byte stream the WebSocket runs over.
+// *socket.Conn of github.com/mdlayher/socket, net.Conn and *tls.Conn all satisfy it.
+type Transport interface {
+	Read(p []byte) (int, error)
+	Write(p []byte) (int, error)
+	Close() error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// Transports that can stop sending while still receiving, like TCP connections
+type halfCloser interface {
+	CloseWrite() error
+}
+
+// Any deadline in the past interrupts the blocking I/O immediately
+var deadlineExceeded = time.Unix(1, 0)
+
+// watchContext makes the blocking I/O on the transport honor the deadline and the cancellation of ctx.
+// The returned function stops watching, clears the deadlines and replaces err with the error of ctx
+// if it was ctx that interrupted the I/O.
+func watchContext(ctx context.Context, sock Transport) func(err error) error {
+	finishRead := watchDeadline(ctx, sock.SetReadDeadline, time.Time{})
+	finishWrite := watchDeadline(ctx, sock.SetWriteDeadline, time.Time{})
+	return func(err error) error {
+		return finishWrite(finishRead(err))
+	}
+}
+
+// watchDeadline is watchContext for a single direction of the I/O. The deadline set is the earliest of
+// the one of ctx and base, and base is restored when the watching stops.
+func watchDeadline(ctx context.Context, setDeadline func(t time.Time) error, base time.Time) func(err error) error {
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline && (base.IsZero() || deadline.Before(base)) {
+		setDeadline(deadline)
+	} else {
+		hasDeadline = false
+	}
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		setDeadline(deadlineExceeded)
+		close(interrupted)
+	})
+	return func(err error) error {
+		if !stop() {
+			// Waiting for the interruption to finish, so it does not override the restored deadline
+			<-interrupted
+		}
+		setDeadline(base)
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// The transport may notice the deadline slightly before the timer of ctx fires
+		if hasDeadline && errors.Is(err, os.ErrDeadlineExceeded) && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+		return err
+	}
+}
+
+// writeBuffers writes header and payload with a single writev where the transport allows it,
+// it must be called with frameMu held
+func (ws *WS) writeBuffers(header, payload []byte) error {
+	ws.iovecs = [2][]byte{header, payload}
+	ws.pending = ws.iovecs[:]
+	defer func() {
+		// Not holding on to the payload of the caller
+		ws.iovecs = [2][]byte{}
+		ws.pending = nil
+	}()
+	if sock, ok := ws.Sock.(*socket.Conn); ok {
+		return ws.writevSocket(sock)
+	}
+	// net.Buffers uses writev on the connections of the net package and writes the buffers one by one elsewhere
+	_, err := ws.pending.WriteTo(ws.Sock)
+	return err
+}
+
+func (ws *WS) writevSocket(sock *socket.Conn) error {
+	if ws.rawConn == nil {
+		rawConn, err := sock.SyscallConn()
+		if err != nil {
+			return err
+		}
+		ws.rawConn = rawConn
+		ws.writev = ws.writevPending
+	}
+	ws.writevErr = nil
+	if err := ws.rawConn.Write(ws.writev); err != nil {
+		return err
+	}
+	return ws.writevErr
+}
+
+// writevPending is called by the runtime poller whenever the socket is writable, it returns false
+// to wait until there is room for the rest of the pending buffers
+func (ws *WS) writevPending(fd uintptr) bool {
+	for len(ws.pending) > 0 {
+		n, err := unix.Writev(int(fd), ws.pending)
+		switch err {
+		case nil:
+		case unix.EINTR:
+			continue
+		case unix.EAGAIN:
+			return false
+		default:
+			ws.writevErr = os.NewSyscallError("writev", err)
+			return true
+		}
+		for n > 0 {
+			if n < len(ws.pending[0]) {
+				ws.pending[0] = ws.pending[0][n:]
+				break
+			}
+			n -= len(ws.pending[0])
+			ws.pending = ws.pending[1:]
+		}
+		// Empty buffers would never be consumed by a write
+		for len(ws.pending) > 0 && len(ws.pending[0]) == 0 {
+			ws.pending = ws.pending[1:]
+		}
+	}
+	return true
+}
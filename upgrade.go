@@ -0,0 +1,92 @@
+package wsoding
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Upgrade performs the server handshake on a request received by a net/http server, so WebSocket
+// endpoints can be served next to regular routes. On failure the error response is already written to w.
+// The connection is hijacked from the server and belongs to the returned WS.
+func Upgrade(w http.ResponseWriter, r *http.Request, opts *AcceptOptions) (*WS, error) {
+	if opts == nil {
+		opts = &AcceptOptions{}
+	}
+	request := newWSRequest(r)
+	secWebSocketKey, err := checkUpgradeRequest(request, opts)
+	if err != nil {
+		return nil, rejectUpgrade(w, err)
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, rejectUpgrade(w, &RejectError{StatusCode: http.StatusInternalServerError, Err: ErrUpgradeNotHijackable})
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, rejectUpgrade(w, &RejectError{StatusCode: http.StatusInternalServerError, Err: err})
+	}
+	// The deadlines of the server were meant for the HTTP exchange, not for the WebSocket
+	conn.SetDeadline(time.Time{})
+	ws := &WS{
+		Sock:    conn,
+		Debug:   opts.Debug,
+		Client:  false,
+		Request: request,
+	}
+	// The client may have sent its first frames right after the request, the server has read them already
+	if n := brw.Reader.Buffered(); n > 0 {
+		buffered, _ := brw.Reader.Peek(n)
+		ws.reader = bufio.NewReaderSize(io.MultiReader(bytes.NewReader(bytes.Clone(buffered)), conn), 4*chunkSize)
+	}
+	ws.Subprotocol = selectSubprotocol(request, opts)
+	ws.negotiateExtensions(request, opts.Extensions)
+	if err := ws.writeHandshakeResponse(secWebSocketKey); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// newWSRequest converts the request parsed by net/http, which moves the Host header out of Header
+func newWSRequest(r *http.Request) *WSRequest {
+	header := r.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	if r.Host != "" {
+		header.Set("Host", r.Host)
+	}
+	return &WSRequest{
+		Method:     r.Method,
+		RequestURI: r.RequestURI,
+		Path:       r.URL.Path,
+		RawQuery:   r.URL.RawQuery,
+		Query:      r.URL.Query(),
+		Proto:      r.Proto,
+		ProtoMajor: r.ProtoMajor,
+		ProtoMinor: r.ProtoMinor,
+		Header:     header,
+	}
+}
+
+// rejectUpgrade writes the HTTP error response corresponding to err through w
+func rejectUpgrade(w http.ResponseWriter, err error) error {
+	reject := handshakeRejection(err)
+	if reject == nil {
+		reject = handshakeRejection(&RejectError{StatusCode: http.StatusInternalServerError, Err: err})
+	}
+	for key, values := range reject.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.WriteHeader(reject.StatusCode)
+	w.Write(reject.Body)
+	return reject
+}
@@ -0,0 +1,157 @@
+package wsoding
+
+import (
+	"encoding/binary"
+)
+
+// RFC 6455 - Section 8.1:
+// > When an endpoint is to interpret a byte stream as UTF-8 but finds
+// > that the byte stream is not, in fact, a valid UTF-8 stream, that
+// > endpoint MUST _Fail the WebSocket Connection_.
+//
+// utf8Validator is a DFA over the well-formed byte sequences of Table 3-7 of the Unicode Standard.
+// The state is kept between the chunks, so a sequence may be split anywhere, and a byte that
+// cannot continue any valid sequence is rejected right away.
+type utf8Validator struct {
+	state utf8State
+}
+
+// The states are named after the bytes still expected to finish the sequence
+type utf8State byte
+
+const (
+	utf8Accept  utf8State = iota
+	utf8Tail1             // 80..BF
+	utf8Tail2             // 80..BF 80..BF
+	utf8AfterE0           // A0..BF 80..BF
+	utf8AfterED           // 80..9F 80..BF, no surrogates
+	utf8AfterF0           // 90..BF 80..BF 80..BF
+	utf8AfterF1           // 80..BF 80..BF 80..BF
+	utf8AfterF4           // 80..8F 80..BF 80..BF, nothing above U+10FFFF
+	utf8Reject
+)
+
+// The classes of the bytes that lead to the same transitions
+const (
+	utf8ASCII   = iota // 00..7F
+	utf8Cont80         // 80..8F
+	utf8Cont90         // 90..9F
+	utf8ContA0         // A0..BF
+	utf8Lead2          // C2..DF
+	utf8LeadE0         // E0
+	utf8Lead3          // E1..EC, EE..EF
+	utf8LeadED         // ED
+	utf8LeadF0         // F0
+	utf8Lead4          // F1..F3
+	utf8LeadF4         // F4
+	utf8Invalid        // C0..C1, F5..FF
+	utf8Classes
+)
+
+var utf8ByteClass = func() (classes [256]byte) {
+	for c := range classes {
+		switch {
+		case c <= 0x7F:
+			classes[c] = utf8ASCII
+		case c <= 0x8F:
+			classes[c] = utf8Cont80
+		case c <= 0x9F:
+			classes[c] = utf8Cont90
+		case c <= 0xBF:
+			classes[c] = utf8ContA0
+		case c <= 0xC1:
+			classes[c] = utf8Invalid
+		case c <= 0xDF:
+			classes[c] = utf8Lead2
+		case c == 0xE0:
+			classes[c] = utf8LeadE0
+		case c == 0xED:
+			classes[c] = utf8LeadED
+		case c <= 0xEF:
+			classes[c] = utf8Lead3
+		case c == 0xF0:
+			classes[c] = utf8LeadF0
+		case c <= 0xF3:
+			classes[c] = utf8Lead4
+		case c == 0xF4:
+			classes[c] = utf8LeadF4
+		default:
+			classes[c] = utf8Invalid
+		}
+	}
+	return classes
+}()
+
+var utf8Transitions = func() (transitions [utf8Reject][utf8Classes]utf8State) {
+	for state := range transitions {
+		for class := range transitions[state] {
+			transitions[state][class] = utf8Reject
+		}
+	}
+	accept := &transitions[utf8Accept]
+	accept[utf8ASCII] = utf8Accept
+	accept[utf8Lead2] = utf8Tail1
+	accept[utf8LeadE0] = utf8AfterE0
+	accept[utf8Lead3] = utf8Tail2
+	accept[utf8LeadED] = utf8AfterED
+	accept[utf8LeadF0] = utf8AfterF0
+	accept[utf8Lead4] = utf8AfterF1
+	accept[utf8LeadF4] = utf8AfterF4
+	for _, class := range []int{utf8Cont80, utf8Cont90, utf8ContA0} {
+		transitions[utf8Tail1][class] = utf8Accept
+		transitions[utf8Tail2][class] = utf8Tail1
+		transitions[utf8AfterF1][class] = utf8Tail2
+	}
+	transitions[utf8AfterE0][utf8ContA0] = utf8Tail1
+	transitions[utf8AfterED][utf8Cont80] = utf8Tail1
+	transitions[utf8AfterED][utf8Cont90] = utf8Tail1
+	transitions[utf8AfterF0][utf8Cont90] = utf8Tail2
+	transitions[utf8AfterF0][utf8ContA0] = utf8Tail2
+	transitions[utf8AfterF4][utf8Cont80] = utf8Tail2
+	return transitions
+}()
+
+// feed fails as soon as the input can no longer be valid, even in the middle of a sequence
+// split between the chunks
+func (v *utf8Validator) feed(payload []byte) error {
+	state := v.state
+	for len(payload) > 0 {
+		// Runs of ASCII are skipped a word at a time
+		if state == utf8Accept {
+			for len(payload) >= 8 && binary.LittleEndian.Uint64(payload)&0x8080808080808080 == 0 {
+				payload = payload[8:]
+			}
+			if len(payload) == 0 {
+				break
+			}
+		}
+		state = utf8Transitions[state][utf8ByteClass[payload[0]]]
+		if state == utf8Reject {
+			v.state = utf8Reject
+			return ErrInvalidUtf8
+		}
+		payload = payload[1:]
+	}
+	v.state = state
+	return nil
+}
+
+// finish reports the sequence left unfinished at the end of the input
+func (v *utf8Validator) finish() error {
+	switch v.state {
+	case utf8Accept:
+		return nil
+	case utf8Reject:
+		return ErrInvalidUtf8
+	default:
+		return ErrShortUtf8
+	}
+}
+
+func verifyUtf8(payload []byte) error {
+	var v utf8Validator
+	if err := v.feed(payload); err != nil {
+		return err
+	}
+	return v.finish()
+}
@@ -0,0 +1,117 @@
+package wsoding
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"unicode/utf8"
+)
+
+var utf8Cases = []struct {
+	name  string
+	input string
+}{
+	{"empty", ""},
+	{"ascii", "Hello, World"},
+	{"long ascii", "the quick brown fox jumps over the lazy dog 0123456789"},
+	{"two bytes", "κόσμε"},
+	{"three bytes", "€ and ‰"},
+	{"four bytes", "𝄞 and 😀"},
+	{"mixed", "Hello-µ@ßöäüàá-UTF-8!!"},
+	{"max code point", "\xf4\x8f\xbf\xbf"},
+	{"last before surrogates", "\xed\x9f\xbf"},
+	{"first after surrogates", "\xee\x80\x80"},
+	{"high surrogate", "\xed\xa0\x80"},
+	{"low surrogate", "\xed\xbf\xbf"},
+	{"surrogate pair", "\xed\xa0\x80\xed\xb0\x80"},
+	{"overlong slash 2", "\xc0\xaf"},
+	{"overlong slash 3", "\xe0\x80\xaf"},
+	{"overlong slash 4", "\xf0\x80\x80\xaf"},
+	{"overlong max 2", "\xc1\xbf"},
+	{"overlong max 3", "\xe0\x9f\xbf"},
+	{"overlong max 4", "\xf0\x8f\xbf\xbf"},
+	{"above max code point", "\xf4\x90\x80\x80"},
+	{"f4 90 prefix", "ab\xf4\x90"},
+	{"f5 lead", "\xf5\x80\x80\x80"},
+	{"ff", "a\xffb"},
+	{"lone continuation", "a\x80b"},
+	{"missing continuation", "\xe2\x82a"},
+	{"truncated two bytes", "abc\xc3"},
+	{"truncated three bytes", "abc\xe2\x82"},
+	{"truncated four bytes", "abc\xf0\x9d\x84"},
+	{"valid then invalid", "κόσμε\xed\xa0\x80 and more"},
+}
+
+// feedChunks feeds input to a fresh validator split at the given positions
+func feedChunks(input []byte, splits ...int) error {
+	var v utf8Validator
+	start := 0
+	for _, split := range append(splits, len(input)) {
+		if err := v.feed(input[start:split]); err != nil {
+			return err
+		}
+		start = split
+	}
+	return v.finish()
+}
+
+func TestUtf8ValidatorMatchesUtf8Valid(t *testing.T) {
+	for _, tc := range utf8Cases {
+		t.Run(tc.name, func(t *testing.T) {
+			input := []byte(tc.input)
+			want := utf8.Valid(input)
+			if got := verifyUtf8(input) == nil; got != want {
+				t.Fatalf("whole input: valid = %v, want %v", got, want)
+			}
+			for i := 0; i <= len(input); i++ {
+				for j := i; j <= len(input); j++ {
+					if got := feedChunks(input, i, j) == nil; got != want {
+						t.Fatalf("split at %d and %d: valid = %v, want %v", i, j, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestUtf8ValidatorRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	edge := []byte{0x00, 0x7f, 0x80, 0x8f, 0x90, 0x9f, 0xa0, 0xbf, 0xc0, 0xc1, 0xc2, 0xdf, 0xe0, 0xe1, 0xed, 0xee, 0xef, 0xf0, 0xf1, 0xf3, 0xf4, 0xf5, 0xff}
+	for range 20000 {
+		input := make([]byte, r.Intn(24))
+		for i := range input {
+			if r.Intn(2) == 0 {
+				input[i] = edge[r.Intn(len(edge))]
+			} else {
+				input[i] = byte(r.Intn(256))
+			}
+		}
+		want := utf8.Valid(input)
+		for i := 0; i <= len(input); i++ {
+			if got := feedChunks(input, i) == nil; got != want {
+				t.Fatalf("% x split at %d: valid = %v, want %v", input, i, got, want)
+			}
+		}
+	}
+}
+
+func TestUtf8ValidatorFailsFast(t *testing.T) {
+	for _, input := range []string{"\xf4\x90", "\xed\xa0", "\xe0\x80", "\xf0\x80", "\xc0", "\xf5", "ab\x80"} {
+		var v utf8Validator
+		if err := v.feed([]byte(input)); !errors.Is(err, ErrInvalidUtf8) {
+			t.Errorf("feed(%q) = %v, want %v", input, err, ErrInvalidUtf8)
+		}
+	}
+}
+
+func TestUtf8ValidatorTruncatedTail(t *testing.T) {
+	for _, input := range []string{"abc\xc3", "abc\xe2\x82", "abc\xf0\x9d\x84", "\xf4\x8f"} {
+		var v utf8Validator
+		if err := v.feed([]byte(input)); err != nil {
+			t.Fatalf("feed(%q) = %v, want nil", input, err)
+		}
+		if err := v.finish(); !errors.Is(err, ErrShortUtf8) {
+			t.Errorf("finish after %q = %v, want %v", input, err, ErrShortUtf8)
+		}
+	}
+}
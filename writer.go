@@ -0,0 +1,125 @@
+package wsoding
+
+import (
+	"io"
+)
+
+// NextWriter starts an outgoing data message and returns the writer of its payload. The payload is sent
+// in frames of FragmentSize as it is written and Close sends the final frame. Other data messages wait
+// until the writer is closed, while control frames may still go between its fragments.
+func (ws *WS) NextWriter(kind WSMessageKind) (io.WriteCloser, error) {
+	if kind != MessageTEXT && kind != MessageBIN {
+		return nil, ErrBadMessageKind
+	}
+	ws.messageMu.Lock()
+	w := &messageWriter{}
+	ws.startMessage(w, kind, -1)
+	w.release = ws.messageMu.Unlock
+	return w, nil
+}
+
+// startMessage prepares w for the next outgoing message, it must be called with messageMu held.
+// The buffer of the frames is kept, so a reused writer does not allocate.
+func (ws *WS) startMessage(w *messageWriter, kind WSMessageKind, size int) {
+	frames := &w.frames
+	*frames = frameWriter{ws: ws, kind: kind, first: true, buffer: frames.buffer[:0]}
+	var payload io.WriteCloser = frames
+	for i := len(ws.extensions) - 1; i >= 0; i-- {
+		var rsv byte
+		payload, rsv = ws.extensions[i].NewWriter(payload, WSMessageInfo{Kind: kind, Size: size, Compress: !ws.noWriteCompression})
+		frames.rsv |= rsv
+	}
+	w.payload = payload
+	w.closed = false
+	w.release = nil
+}
+
+func (ws *WS) fragmentSize() int {
+	if ws.FragmentSize <= 0 {
+		return chunkSize
+	}
+	return ws.FragmentSize
+}
+
+// messageWriter is the writer of an outgoing message that NextWriter returns
+type messageWriter struct {
+	frames  frameWriter
+	payload io.WriteCloser // The frames after the extensions
+	closed  bool
+	release func() // Releases messageMu on Close if the writer was the one to take it
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrWriterClosed
+	}
+	return w.payload.Write(p)
+}
+
+func (w *messageWriter) Close() error {
+	if w.closed {
+		return ErrWriterClosed
+	}
+	w.closed = true
+	if w.release != nil {
+		defer w.release()
+	}
+	return w.payload.Close()
+}
+
+// frameWriter splits the payload of a message into frames. It holds back the last fragment,
+// so the frame with FIN is never empty unless the whole message is.
+type frameWriter struct {
+	ws     *WS
+	kind   WSMessageKind
+	rsv    byte // Reserved bits of the first frame set by the extensions
+	first  bool
+	buffer []byte
+	err    error
+}
+
+func (w *frameWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	written := len(p)
+	size := w.ws.fragmentSize()
+	for len(w.buffer)+len(p) > size {
+		if len(w.buffer) == 0 {
+			// Nothing is held back, the fragment goes straight from p
+			if err := w.sendFragment(false, p[:size]); err != nil {
+				return written - len(p), err
+			}
+			p = p[size:]
+			continue
+		}
+		n := size - len(w.buffer)
+		w.buffer = append(w.buffer, p[:n]...)
+		p = p[n:]
+		if err := w.sendFragment(false, w.buffer); err != nil {
+			return written - len(p) - n, err
+		}
+		w.buffer = w.buffer[:0]
+	}
+	w.buffer = append(w.buffer, p...)
+	return written, nil
+}
+
+func (w *frameWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.sendFragment(true, w.buffer)
+}
+
+func (w *frameWriter) sendFragment(fin bool, payload []byte) error {
+	opcode := OpCodeCONT
+	var rsv byte
+	if w.first {
+		opcode = WSOpcode(w.kind)
+		rsv = w.rsv
+		w.first = false
+	}
+	w.err = w.ws.sendFrame(fin, rsv, opcode, payload)
+	return w.err
+}
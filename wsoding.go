@@ -1,33 +1,158 @@
 package wsoding
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"math"
+	"net"
+	"net/http"
+	"slices"
 	"strings"
+	"sync"
 	"syscall"
-
-	"github.com/mdlayher/socket"
+	"time"
+	"unsafe"
 )
 
 const chunkSize int = 1024
 
+// The outgoing frames are assembled in buffers shared by all the connections, a frame that fits
+// into one is sent with a single write
+const writeBufferSize int = 4 * chunkSize
+
+var writeBufferPool = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, writeBufferSize)
+		return &buffer
+	},
+}
+
+// ReadMessage collects the payload in the buffers shared by all the connections, only the result is allocated
+const maxPooledReadBuffer int = 1 << 20
+
+var readBufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
 type WS struct {
-	Sock   *socket.Conn
-	Debug  bool
-	Client bool
+	Sock    Transport
+	Debug   bool
+	Client  bool
+	Request *WSRequest // Upgrade request of the client, only set on the server side
+	// Subprotocol negotiated through Sec-WebSocket-Protocol, empty if none was selected
+	Subprotocol string
+	// Extensions negotiated through Sec-WebSocket-Extensions in the order they are applied
+	Extensions []ExtensionParams
+	extensions []NegotiatedExtension
+	// LaxMasking accepts frames regardless of whether they are masked, only meant for testing
+	LaxMasking bool
+	// CloseTimeout limits how long CloseWithCode waits for the CLOSE of the peer, defaults to 5 seconds
+	CloseTimeout time.Duration
+	// OnPing is called on the reading goroutine with the payload of every PING of the peer,
+	// after the PONG answering it has been sent. The payload is only valid until OnPing returns.
+	OnPing func(payload []byte)
+	// OnPong is called on the reading goroutine with the payload of every PONG of the peer. rtt is the
+	// round trip time of the PING it answers, zero if it is unsolicited. The payload is only valid
+	// until OnPong returns.
+	OnPong func(payload []byte, rtt time.Duration)
+	// OnClose is called on the reading goroutine with the CLOSE of the peer, before it is answered
+	// and returned from ReadMessage as *CloseError
+	OnClose func(code WSCloseCode, reason string)
+	// FragmentSize is the payload size of the frames outgoing data messages are split into, defaults to 1024
+	FragmentSize int
+	// MaxFrameSize and MaxMessageSize limit the payload of the incoming frames and data messages, the
+	// connection is closed with 1009 Message Too Big when they are exceeded. No limit if zero.
+	MaxFrameSize   int
+	MaxMessageSize int
+
+	reader             *bufio.Reader
+	message            incomingMessage // The message NextReader has returned the reader of
+	noWriteCompression bool
+	closeReceived      *CloseError
+
+	// The state of the frames is reused from one to another, so the steady state of the connection
+	// allocates nothing
+	header         [14]byte      // Incoming frame header
+	controlPayload [125]byte     // Payload of the incoming control frame, only valid while it is handled
+	writer         messageWriter // Writer of SendMessage, guarded by messageMu
+	// The rest is guarded by frameMu
+	maskKeys     [64]byte
+	maskKeysLeft []byte
+	iovecs       [2][]byte
+	pending      net.Buffers // What is left of iovecs to write
+	rawConn      syscall.RawConn
+	writev       func(fd uintptr) bool // writevPending, bound once
+	writevErr    error
+
+	// RFC 6455 - Section 5.4:
+	// > An endpoint MUST be capable of handling control frames in the
+	// > middle of a fragmented message.
+	// messageMu is held for the whole outgoing data message, so the fragments of concurrent messages
+	// do not interleave. frameMu is held for a single frame, so control frames may go between the fragments.
+	messageMu sync.Mutex
+	frameMu   sync.Mutex
+	closeSent bool  // Guarded by frameMu
+	writeErr  error // Guarded by frameMu
+	// readErr breaks the connection for reading after the input stopped in the middle of a frame
+	readErr error
+
+	// done is closed by Close, it stops the goroutines serving the connection in the background
+	done      chan struct{}
+	doneOnce  sync.Once
+	closeOnce sync.Once
+
+	pingMu   sync.Mutex
+	pings    map[string]time.Time // Outstanding PINGs by payload
+	pingSeq  uint64
+	rtt      time.Duration
+	peerDead bool
+
+	deadlineMu    sync.Mutex
+	readDeadline  time.Time // Deadlines set through WS, restored after the ones of contexts
+	writeDeadline time.Time
+}
+
+type AcceptOptions struct {
+	// Debug of the accepted connections, set before any goroutine may use them
+	Debug          bool
+	MaxHeaderBytes int // Limit on the size of the upgrade request, defaults to 64KiB
+	// CheckOrigin rejects the upgrade with 403 Forbidden if it returns false. All origins are allowed if nil.
+	CheckOrigin func(request *WSRequest) bool
+	// Subprotocols supported by the server in the order of preference
+	Subprotocols []string
+	// SelectSubprotocol picks one of the subprotocols offered by the client, an empty string selects none.
+	// By default the first of Subprotocols offered by the client is selected.
+	SelectSubprotocol func(request *WSRequest, offered []string) string
+	// Extensions the server is willing to accept in the order of preference
+	Extensions []Extension
+	// CheckRequest is called after the request has been validated. Returning a *RejectError sends
+	// the response described by it, any other error rejects the upgrade with 403 Forbidden.
+	CheckRequest func(request *WSRequest) error
 }
 
 func (ws *WS) Close() error {
+	ws.closeOnce.Do(func() {
+		close(ws.doneChan())
+	})
 	// Base on the ideas from https://blog.netherlabs.nl/articles/2009/01/18/the-ultimate-so_linger-page-or-why-is-my-tcp-not-reliable
 	// Informing the OS that we are not planning to send anything anymore
-	if err := ws.Sock.Shutdown(syscall.SHUT_WR); err != nil {
-		return err
+	// Without the half-close the peer would never see the end of our input, so there is nothing to wait for
+	sock, ok := ws.Sock.(halfCloser)
+	if !ok {
+		return ws.Sock.Close()
+	}
+	if err := sock.CloseWrite(); err != nil {
+		return errors.Join(err, ws.Sock.Close())
 	}
 	// Depleting input before closing socket, so the OS does not send RST just because we have some input pending on close
 	buffer := make([]byte, 1024)
@@ -35,7 +160,7 @@ func (ws *WS) Close() error {
 		n, err := ws.Sock.Read(buffer)
 		if err != nil {
 			if !errors.Is(err, io.EOF) {
-				return err
+				return errors.Join(err, ws.Sock.Close())
 			}
 		}
 		if n == 0 {
@@ -46,15 +171,18 @@ func (ws *WS) Close() error {
 	return ws.Sock.Close() // Actually destroying the socket
 }
 
-func (ws *WS) readEntireBufferRaw(buffer []byte) error {
-	for len(buffer) > 0 {
-		n, err := ws.Sock.Read(buffer)
-		if err != nil {
-			return err
-		}
-		buffer = buffer[n:]
+// bufferedReader returns the reader all the input of the transport goes through, the handshake
+// may leave the beginning of the first frames in it.
+func (ws *WS) bufferedReader() *bufio.Reader {
+	if ws.reader == nil {
+		ws.reader = bufio.NewReaderSize(ws.Sock, 4*chunkSize)
 	}
-	return nil
+	return ws.reader
+}
+
+func (ws *WS) readEntireBufferRaw(buffer []byte) error {
+	_, err := io.ReadFull(ws.bufferedReader(), buffer)
+	return err
 }
 
 func (ws *WS) writeEntireBufferRaw(buffer []byte) error {
@@ -68,247 +196,332 @@ func (ws *WS) writeEntireBufferRaw(buffer []byte) error {
 	return nil
 }
 
-func (ws *WS) peekRaw(ctx context.Context, buffer []byte) (int, error) {
-	n, _, err := ws.Sock.Recvfrom(ctx, buffer, syscall.MSG_PEEK)
-	if err != nil {
-		return 0, err
-	}
-	return n, nil
-}
-
-// TODO: make nonblocking version of c3ws::accept
-
-func Accept(ctx context.Context, sock *socket.Conn) (WS, error) {
-	ws := WS{
+func Accept(ctx context.Context, sock Transport, opts *AcceptOptions) (*WS, error) {
+	ws := &WS{
 		Sock:   sock,
 		Client: false,
 	}
-	err := ws.ServerHandshake(ctx)
+	if opts != nil {
+		ws.Debug = opts.Debug
+	}
+	err := ws.ServerHandshake(ctx, opts)
 	if err != nil {
-		return WS{}, err
+		return nil, err
 	}
 	return ws, nil
 }
 
-// TODO: connect should just accept a ws/wss URL
+// AcceptResult is the outcome of the handshake started by AcceptAsync
+type AcceptResult struct {
+	WS   *WS
+	Sock Transport // The socket the handshake ran on, left open on failure for the caller to close
+	Err  error
+}
+
+// AcceptAsync performs the server handshake on its own goroutine, so the accept loop can go on with the
+// following connections while a slow client is still sending its request. The handshake honors the
+// cancellation and the deadline of ctx. The returned channel receives exactly one result.
+func AcceptAsync(ctx context.Context, sock Transport, opts *AcceptOptions) <-chan AcceptResult {
+	result := make(chan AcceptResult, 1)
+	go func() {
+		ws, err := Accept(ctx, sock, opts)
+		result <- AcceptResult{WS: ws, Sock: sock, Err: err}
+	}()
+	return result
+}
 
-func Connect(ctx context.Context, sock *socket.Conn, host string, endpoint string) (WS, error) {
-	ws := WS{
+func Connect(ctx context.Context, sock Transport, host string, endpoint string, opts *DialOptions) (*WS, error) {
+	ws := &WS{
 		Sock:   sock,
 		Client: true,
 	}
-	err := ws.ClientHandshake(ctx, host, endpoint)
+	if opts != nil {
+		ws.Debug = opts.Debug
+	}
+	err := ws.ClientHandshake(ctx, host, endpoint, opts)
 	if err != nil {
-		return WS{}, err
+		return nil, err
 	}
 	return ws, nil
 }
 
-func (ws *WS) ServerHandshake(ctx context.Context) error {
-	// TODO: Ws.server_handshake assumes that request fits into 1024 bytes
-	buffer := make([]byte, 1024)
-	bufferSize, err := ws.peekRaw(ctx, buffer)
+// https://datatracker.ietf.org/doc/html/rfc6455#section-4.2
+
+func (ws *WS) ServerHandshake(ctx context.Context, opts *AcceptOptions) (err error) {
+	finish := watchContext(ctx, ws.Sock)
+	defer func() {
+		err = finish(err)
+	}()
+	if opts == nil {
+		opts = &AcceptOptions{}
+	}
+	parser, err := ws.readHTTPHead(opts.MaxHeaderBytes)
 	if err != nil {
-		return err
+		return ws.rejectHandshake(err)
 	}
-	request := string(buffer[:bufferSize])
-	secWebSocketKey, err := parseSecWebSocketKeyFromRequest(&request)
+	request, err := parseHTTPRequest(parser)
 	if err != nil {
-		return err
+		return ws.rejectHandshake(err)
 	}
-	_, err = ws.Sock.Read(buffer[0 : bufferSize-len(request)])
+	secWebSocketKey, err := checkUpgradeRequest(request, opts)
 	if err != nil {
-		return err
+		return ws.rejectHandshake(err)
+	}
+	ws.Request = request
+	ws.Subprotocol = selectSubprotocol(request, opts)
+	ws.negotiateExtensions(request, opts.Extensions)
+	return ws.writeHandshakeResponse(secWebSocketKey)
+}
+
+// checkUpgradeRequest verifies the request and lets the application reject it, returns the Sec-WebSocket-Key
+func checkUpgradeRequest(request *WSRequest, opts *AcceptOptions) (string, error) {
+	secWebSocketKey, err := verifyUpgradeRequest(request)
+	if err != nil {
+		return "", err
+	}
+	// RFC 6455 - Section 4.2.2:
+	// > If the server does not wish to accept this connection, it MUST return an
+	// > appropriate HTTP error code (e.g., 403 Forbidden) and abort the WebSocket handshake
+	if opts.CheckOrigin != nil && !opts.CheckOrigin(request) {
+		return "", ErrServerHandshakeBadOrigin
+	}
+	if opts.CheckRequest != nil {
+		if err := opts.CheckRequest(request); err != nil {
+			var reject *RejectError
+			if !errors.As(err, &reject) {
+				err = &RejectError{StatusCode: http.StatusForbidden, Err: err}
+			}
+			return "", err
+		}
 	}
+	return secWebSocketKey, nil
+}
+
+func (ws *WS) writeHandshakeResponse(secWebSocketKey string) error {
 	var handshake strings.Builder
 	handshake.Grow(1024)
 	handshake.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
 	handshake.WriteString("Upgrade: websocket\r\n")
 	handshake.WriteString("Connection: Upgrade\r\n")
 	handshake.WriteString(fmt.Sprintf("Sec-WebSocket-Accept: %s\r\n", computeSecWebSocketAccept(secWebSocketKey)))
-	handshake.WriteString("\r\n")
-	_, err = ws.Sock.Write([]byte(handshake.String()))
-	if err != nil {
-		return err
+	if ws.Subprotocol != "" {
+		handshake.WriteString(fmt.Sprintf("Sec-WebSocket-Protocol: %s\r\n", ws.Subprotocol))
 	}
-	return nil
+	if len(ws.Extensions) > 0 {
+		handshake.WriteString(fmt.Sprintf("Sec-WebSocket-Extensions: %s\r\n", formatExtensions(ws.Extensions)))
+	}
+	handshake.WriteString("\r\n")
+	return ws.writeEntireBufferRaw([]byte(handshake.String()))
 }
 
 // https://datatracker.ietf.org/doc/html/rfc6455#section-1.3
-// TODO: Ws.client_handshake should just accept a ws/wss URL
 
-func (ws *WS) ClientHandshake(ctx context.Context, host, endpoint string) error {
+func (ws *WS) ClientHandshake(ctx context.Context, host, endpoint string, opts *DialOptions) (err error) {
+	finish := watchContext(ctx, ws.Sock)
+	defer func() {
+		err = finish(err)
+	}()
+	if opts == nil {
+		opts = &DialOptions{}
+	}
 	var handshake strings.Builder
 	handshake.Grow(1024)
-	// TODO: customizable resource path
 	handshake.WriteString(fmt.Sprintf("GET %s HTTP/1.1\r\n", endpoint))
 	handshake.WriteString(fmt.Sprintf("Host: %s\r\n", host))
 	handshake.WriteString("Upgrade: websocket\r\n")
 	handshake.WriteString("Connection: Upgrade\r\n")
-	// TODO: Custom WebSocket key
-	// Maybe even hardcode something that identifies c3ws?
-	handshake.WriteString("Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n")
+	secWebSocketKey, err := generateSecWebSocketKey()
+	if err != nil {
+		return err
+	}
+	handshake.WriteString(fmt.Sprintf("Sec-WebSocket-Key: %s\r\n", secWebSocketKey))
 	handshake.WriteString("Sec-WebSocket-Version: 13\r\n")
+	if len(opts.Subprotocols) > 0 {
+		handshake.WriteString(fmt.Sprintf("Sec-WebSocket-Protocol: %s\r\n", strings.Join(opts.Subprotocols, ", ")))
+	}
+	if offers := offerExtensions(opts.Extensions); offers != "" {
+		handshake.WriteString(fmt.Sprintf("Sec-WebSocket-Extensions: %s\r\n", offers))
+	}
 	handshake.WriteString("\r\n")
-	_, err := ws.Sock.Write([]byte(handshake.String()))
+	err = ws.writeEntireBufferRaw([]byte(handshake.String()))
 	if err != nil {
 		return err
 	}
-	// TODO: Ws.client_handshake assumes that response fits into 1024 bytes
-	buffer := make([]byte, 1024)
-	bufferSize, err := ws.peekRaw(ctx, buffer)
+	parser, err := ws.readHTTPHead(0)
 	if err != nil {
 		return err
 	}
-	response := string(buffer[0:bufferSize])
-	secWebSocketAccept, err := parseSecWebSocketAcceptFromResponse(&response)
+	response, err := parseHTTPResponse(parser)
 	if err != nil {
 		return err
 	}
-	_, err = ws.Sock.Read(buffer[0 : bufferSize-len(response)])
-	if err != nil {
+	// RFC 6455 - Section 4.1:
+	// > If the status code received from the server is not 101, the
+	// > client handles the response per HTTP [RFC2616] procedures.
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		response.Body, err = ws.readHTTPBody(response.Header, maxResponseBodyBytes)
+		if err != nil {
+			return errors.Join(response, err)
+		}
+		return response
+	}
+	if err := verifyUpgradeResponse(response.Header, secWebSocketKey); err != nil {
 		return err
 	}
-	if secWebSocketAccept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
-		return ErrClientHandshakeBadAccept
+	// > 6. If the response includes a |Sec-WebSocket-Protocol| header field
+	// >    and this header field indicates the use of a subprotocol that was
+	// >    not present in the client's handshake (the server has indicated a
+	// >    subprotocol not requested by the client), the client MUST _Fail
+	// >    the WebSocket Connection_.
+	if protocols := response.Header.Values("Sec-WebSocket-Protocol"); len(protocols) > 0 {
+		if len(protocols) > 1 || !slices.Contains(opts.Subprotocols, protocols[0]) {
+			return ErrClientHandshakeBadSubprotocol
+		}
+		ws.Subprotocol = protocols[0]
+	}
+	// > 5. If the response includes a |Sec-WebSocket-Extensions| header
+	// >    field and this header field indicates the use of an extension
+	// >    that was not present in the client's handshake (the server has
+	// >    indicated an extension not requested by the client), the client
+	// >    MUST _Fail the WebSocket Connection_.
+	return ws.acceptExtensions(response.Header, opts.Extensions)
+}
+
+// SendFrame sends a single frame. It is safe to call concurrently with the other senders, but the frames
+// of a message fragmented by hand may interleave with the data frames sent by other goroutines.
+func (ws *WS) SendFrame(fin bool, opcode WSOpcode, payload []byte) error {
+	return ws.sendFrame(fin, 0, opcode, payload)
+}
+
+func (ws *WS) sendFrame(fin bool, rsv byte, opcode WSOpcode, payload []byte) error {
+	ws.frameMu.Lock()
+	defer ws.frameMu.Unlock()
+	// A frame interrupted halfway leaves the peer expecting the rest of it, nothing else can be sent after it
+	if ws.writeErr != nil {
+		return ws.writeErr
+	}
+	// RFC 6455 - Section 5.5.1:
+	// > The application MUST NOT send any more data frames after sending a
+	// > Close frame.
+	if ws.closeSent {
+		return ErrCloseSent
+	}
+	if opcode == OpCodeCLOSE {
+		ws.closeSent = true
+	}
+	if err := ws.writeFrame(fin, rsv, opcode, payload); err != nil {
+		ws.writeErr = err
+		return err
 	}
 	return nil
 }
 
-func (ws *WS) SendFrame(fin bool, opcode WSOpcode, payload []byte) error {
+func (ws *WS) writeFrame(fin bool, rsv byte, opcode WSOpcode, payload []byte) error {
 	if ws.Debug {
-		fmt.Printf("WSODING DEBUG: TX FRAME: FIN(%v), OPCODE(%s), RSV(000), PAYLOAD_LEN: %d\n", fin, opcode.name(), len(payload))
-	}
-	// Send FIN and OPCODE
-	{
-		// NOTE: FIN is always set
-		data := byte(opcode)
-		if fin {
-			data |= (1 << 7)
-		}
-		err := ws.writeEntireBufferRaw([]byte{data})
-		if err != nil {
+		fmt.Printf("WSODING DEBUG: TX FRAME: FIN(%v), OPCODE(%s), RSV(%03b), PAYLOAD_LEN: %d\n", fin, opcode.name(), rsv>>4, len(payload))
+	}
+	buffer := writeBufferPool.Get().(*[]byte)
+	defer writeBufferPool.Put(buffer)
+	frame := ws.appendFrameHeader((*buffer)[:0], fin, rsv, opcode, len(payload))
+	if !ws.Client {
+		if len(frame)+len(payload) <= cap(frame) {
+			return ws.writeEntireBufferRaw(append(frame, payload...))
+		}
+		// Copying a large payload costs more than handing it to the kernel as it is
+		return ws.writeBuffers(frame, payload)
+	}
+	// NOTE: client frames are always masked
+	// The payload is masked into the buffer behind the header, so the first write carries both
+	mask := [4]byte(frame[len(frame)-4:])
+	for pos := 0; ; {
+		chunk := frame[len(frame) : len(frame)+min(len(payload)-pos, cap(frame)-len(frame))]
+		copy(chunk, payload[pos:])
+		maskBytes(mask, pos, chunk)
+		if err := ws.writeEntireBufferRaw(frame[:len(frame)+len(chunk)]); err != nil {
 			return err
 		}
+		pos += len(chunk)
+		if pos == len(payload) {
+			return nil
+		}
+		frame = frame[:0]
 	}
-	// Send masked and payload length
-	{
-		// TODO: do we need to reverse the bytes on a machine with a different endianess than x86?
-		// NOTE: client frames are always masked
-		if len(payload) < 126 {
-			var data byte
-			if ws.Client {
-				data = 1 << 7
-			}
-			data |= byte(len(payload))
-			err := ws.writeEntireBufferRaw([]byte{data})
-			if err != nil {
-				return err
-			}
-		} else if len(payload) <= math.MaxUint16 {
-			var data byte
-			if ws.Client {
-				data = 1 << 7
-			}
-			data |= 126
-			err := ws.writeEntireBufferRaw([]byte{data})
-			if err != nil {
-				return err
-			}
-			length := []byte{
-				byte(len(payload)>>(8*1)) & 0xFF,
-				byte(len(payload)>>(8*0)) & 0xFF}
-			err = ws.writeEntireBufferRaw(length)
-			if err != nil {
-				return err
-			}
+}
 
-		} else if len(payload) > math.MaxUint16 {
-			var data byte
-			if ws.Client {
-				data = 1 << 7
-			}
-			data |= 127
-			length := []byte{
-				byte(len(payload)>>(8*7)) & 0xFF,
-				byte(len(payload)>>(8*6)) & 0xFF,
-				byte(len(payload)>>(8*5)) & 0xFF,
-				byte(len(payload)>>(8*4)) & 0xFF,
-				byte(len(payload)>>(8*3)) & 0xFF,
-				byte(len(payload)>>(8*2)) & 0xFF,
-				byte(len(payload)>>(8*1)) & 0xFF,
-				byte(len(payload)>>(8*0)) & 0xFF}
-			err := ws.writeEntireBufferRaw([]byte{data})
-			if err != nil {
-				return err
-			}
-			err = ws.writeEntireBufferRaw(length)
-			if err != nil {
-				return err
-			}
-		}
+func (ws *WS) appendFrameHeader(frame []byte, fin bool, rsv byte, opcode WSOpcode, payloadLen int) []byte {
+	// FIN, RSV and OPCODE
+	data := byte(opcode) | rsv
+	if fin {
+		data |= (1 << 7)
 	}
+	frame = append(frame, data)
+	// MASK and payload length
+	var masked byte
 	if ws.Client {
-		// Generate and send mask
-		var mask [4]byte
-		rand.Read(mask[:])
-		err := ws.writeEntireBufferRaw(mask[:])
-		if err != nil {
-			return err
-		}
-		for i := 0; i < len(payload); {
-			chunk := make([]byte, 1024)
-			chunkSize := 0
-			for i < len(payload) && chunkSize < len(chunk) {
-				chunk[chunkSize] = payload[i] ^ mask[i%4]
-				chunkSize++
-				i++
-			}
-			err := ws.writeEntireBufferRaw(chunk[0:chunkSize])
-			if err != nil {
-				return err
-			}
-		}
-
-	} else {
-		err := ws.writeEntireBufferRaw(payload)
-		if err != nil {
-			return err
-		}
+		masked = 1 << 7
+	}
+	switch {
+	case payloadLen < 126:
+		frame = append(frame, masked|byte(payloadLen))
+	case payloadLen <= math.MaxUint16:
+		frame = append(frame, masked|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(payloadLen))
+	default:
+		frame = append(frame, masked|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(payloadLen))
 	}
-	return nil
+	if ws.Client {
+		mask := ws.nextMaskKey()
+		frame = append(frame, mask[:]...)
+	}
+	return frame
+}
+
+// nextMaskKey must be called with frameMu held. The keys are cut from a block of random bytes,
+// so crypto/rand is not called for every frame.
+//
+// RFC 6455 - Section 5.3:
+// > The masking key needs to be unpredictable; thus, the masking key MUST be
+// > derived from a strong source of entropy
+func (ws *WS) nextMaskKey() [4]byte {
+	if len(ws.maskKeysLeft) == 0 {
+		rand.Read(ws.maskKeys[:])
+		ws.maskKeysLeft = ws.maskKeys[:]
+	}
+	mask := [4]byte(ws.maskKeysLeft)
+	ws.maskKeysLeft = ws.maskKeysLeft[4:]
+	return mask
 }
 
+// SendMessage sends the message fragmented into frames of FragmentSize. It is safe to call concurrently,
+// the messages are sent one after another. A text message that is not valid UTF-8 is not sent at all.
 func (ws *WS) SendMessage(kind WSMessageKind, payload []byte) error {
-	first := true
-	for {
-		length := len(payload)
-		if length > chunkSize {
-			length = chunkSize
-		}
-		fin := len(payload)-length == 0
-		opcode := OpCodeCONT
-		if first {
-			opcode = WSOpcode(kind)
-		}
-		if opcode == OpCodeCONT && len(payload) == 0 {
-			break
-		}
-		err := ws.SendFrame(fin, opcode, payload[0:length])
-		if err != nil {
+	ws.messageMu.Lock()
+	defer ws.messageMu.Unlock()
+	return ws.sendMessage(kind, payload)
+}
+
+// sendMessage must be called with messageMu held
+func (ws *WS) sendMessage(kind WSMessageKind, payload []byte) error {
+	// RFC 6455 - Section 5.6:
+	// > The "Payload data" is text data encoded as UTF-8.
+	if kind == MessageTEXT {
+		if err := verifyUtf8(payload); err != nil {
 			return err
 		}
-		payload = payload[length:]
-		first = false
-		if len(payload) == 0 {
-			break
-		}
 	}
-	return nil
+	w := &ws.writer
+	ws.startMessage(w, kind, len(payload))
+	if _, err := w.Write(payload); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
 }
 
 func (ws *WS) SendText(text string) error {
-	return ws.SendMessage(MessageTEXT, []byte(text))
+	// The payload is only ever read, so the text is sent without copying it
+	return ws.SendMessage(MessageTEXT, unsafe.Slice(unsafe.StringData(text), len(text)))
 }
 
 func (ws *WS) SendBinary(binary []byte) error {
@@ -316,7 +529,7 @@ func (ws *WS) SendBinary(binary []byte) error {
 }
 
 func (ws *WS) readFrameHeader() (WSFrameHeader, error) {
-	header := make([]byte, 2)
+	header := ws.header[:2]
 	// Read the header
 	err := ws.readEntireBufferRaw(header)
 	if err != nil {
@@ -333,27 +546,28 @@ func (ws *WS) readFrameHeader() (WSFrameHeader, error) {
 	}
 	// Parse the payload length
 	{
-		// TODO: do we need to reverse the bytes on a machine with a different endianess than x86?
 		length := headerMacro(header, "payload_len")
 		switch length {
 		case 126:
-			extLen := make([]byte, 2)
+			extLen := ws.header[2:4]
 			err := ws.readEntireBufferRaw(extLen)
 			if err != nil {
 				return WSFrameHeader{}, err
 			}
-			for i := 0; i < len(extLen); i++ {
-				frameHeader.payloadLen = (frameHeader.payloadLen << 8) | int(extLen[i])
-			}
+			frameHeader.payloadLen = int(binary.BigEndian.Uint16(extLen))
 		case 127:
-			extLen := make([]byte, 8)
+			extLen := ws.header[2:10]
 			err := ws.readEntireBufferRaw(extLen)
 			if err != nil {
 				return WSFrameHeader{}, err
 			}
-			for i := 0; i < len(extLen); i++ {
-				frameHeader.payloadLen = (frameHeader.payloadLen << 8) | int(extLen[i])
+			// RFC 6455 - Section 5.2:
+			// > If 127, the following 8 bytes interpreted as a 64-bit unsigned integer (the
+			// > most significant bit MUST be 0) are the payload length.
+			if extLen[0]&0x80 != 0 {
+				return WSFrameHeader{}, ws.failConnection(CloseProtocolError, ErrBadPayloadLength)
 			}
+			frameHeader.payloadLen = int(binary.BigEndian.Uint64(extLen))
 		default:
 			frameHeader.payloadLen = int(length)
 		}
@@ -368,6 +582,9 @@ func (ws *WS) readFrameHeader() (WSFrameHeader, error) {
 	if frameHeader.opcode.isControl() && (frameHeader.payloadLen > 125 || !frameHeader.fin) {
 		return WSFrameHeader{}, ErrControlFrameTooBig
 	}
+	if ws.MaxFrameSize > 0 && frameHeader.payloadLen > ws.MaxFrameSize {
+		return WSFrameHeader{}, ws.failConnection(CloseMessageTooBig, ErrFrameTooBig)
+	}
 
 	// RFC 6455 - Section 5.2:
 	// >  RSV1, RSV2, RSV3:  1 bit each
@@ -377,16 +594,40 @@ func (ws *WS) readFrameHeader() (WSFrameHeader, error) {
 	// >     the negotiated extensions defines the meaning of such a nonzero
 	// >     value, the receiving endpoint MUST _Fail the WebSocket
 	// >     Connection_.
-	if frameHeader.rsv1 || frameHeader.rsv2 || frameHeader.rsv3 {
-		return WSFrameHeader{}, ErrReservedBitsNotNegotiated
+	//
+	// The negotiated extensions operate on whole messages, so their bits are only
+	// allowed on the first frame of a data message.
+	if rsv := frameHeader.rsv(); rsv != 0 {
+		if rsv&^ws.negotiatedRSV() != 0 || frameHeader.opcode.isControl() || frameHeader.opcode == OpCodeCONT {
+			return WSFrameHeader{}, ErrReservedBitsNotNegotiated
+		}
+	}
+
+	// RFC 6455 - Section 5.1:
+	// > The server MUST close the connection upon receiving a
+	// > frame that is not masked.  In this case, a server MAY send a Close
+	// > frame with a status code of 1002 (protocol error) as defined in
+	// > Section 7.4.1.  A server MUST NOT mask any frames that it sends to
+	// > the client.  A client MUST close a connection if it detects a masked
+	// > frame.  In this case, it MAY use the status code 1002 (protocol
+	// > error) as defined in Section 7.4.1.
+	if !ws.LaxMasking {
+		if ws.Client && frameHeader.masked {
+			return WSFrameHeader{}, ws.failConnection(CloseProtocolError, ErrMaskedServerFrame)
+		}
+		if !ws.Client && !frameHeader.masked {
+			return WSFrameHeader{}, ws.failConnection(CloseProtocolError, ErrUnmaskedClientFrame)
+		}
 	}
 
 	// Read the mask if masked
 	if frameHeader.masked {
-		err := ws.readEntireBufferRaw(frameHeader.mask[:])
+		mask := ws.header[10:14]
+		err := ws.readEntireBufferRaw(mask)
 		if err != nil {
 			return WSFrameHeader{}, err
 		}
+		frameHeader.mask = [4]byte(mask)
 	}
 	return frameHeader, nil
 }
@@ -396,22 +637,20 @@ func (ws *WS) readFramePayloadChunk(frameHeader WSFrameHeader, payload []byte, p
 		return 0, nil
 	}
 	unfinishedPayload := payload[payloadSize:]
-	n, err := ws.Sock.Read(unfinishedPayload)
+	n, err := ws.bufferedReader().Read(unfinishedPayload)
 	if err != nil {
 		return 0, err
 	}
 
 	if frameHeader.masked {
-		for i := range unfinishedPayload {
-
-			unfinishedPayload[i] ^= frameHeader.mask[(payloadSize+i)%4]
-		}
+		maskBytes(frameHeader.mask, payloadSize, unfinishedPayload[:n])
 	}
 	return n, nil
 }
 
-func (ws *WS) readFrameEntirePayload(frameHeader WSFrameHeader) ([]byte, error) {
-	payload := make([]byte, frameHeader.payloadLen)
+// readControlPayload reads the payload of a control frame, which is only valid until the next one
+func (ws *WS) readControlPayload(frameHeader WSFrameHeader) ([]byte, error) {
+	payload := ws.controlPayload[:frameHeader.payloadLen]
 	payloadSize := 0
 	for payloadSize < len(payload) {
 		n, err := ws.readFramePayloadChunk(frameHeader, payload, payloadSize)
@@ -423,119 +662,98 @@ func (ws *WS) readFrameEntirePayload(frameHeader WSFrameHeader) ([]byte, error)
 	return payload, nil
 }
 
+// ReadMessage reads the next data message entirely into memory, see NextReader for streaming it.
+// Only the returned message is allocated, the payload is collected in a shared buffer.
 func (ws *WS) ReadMessage() (*WSMessage, error) {
-	var message WSMessage
-	payload := make([]byte, 0, 1024)
-	var cont bool
-	var verifyPos int
-loop:
-	for {
-		frame, err := ws.readFrameHeader()
-		if err != nil {
-			return nil, err
-		}
-		if frame.opcode.isControl() {
-			switch frame.opcode {
-			case OpCodeCLOSE:
-				return nil, ErrCloseFrameSent
-			case OpCodePING:
-				b, err := ws.readFrameEntirePayload(frame)
-				if err != nil {
-					return nil, err
-				}
-				err = ws.SendFrame(true, OpCodePONG, b)
-				if err != nil {
-					return nil, err
-				}
-			case OpCodePONG:
-				_, err := ws.readFrameEntirePayload(frame)
-				if err != nil {
-					return nil, err
-				}
-				// Unsolicited PONGs are just ignored
-				break loop
-			default:
-				return nil, ErrUnexpectedOpCode
-			}
-		} else {
-			if !cont {
-				switch frame.opcode {
-				case OpCodeTEXT, OpCodeBIN:
-					message.Kind = WSMessageKind(frame.opcode)
-				default:
-					return nil, ErrUnexpectedOpCode
-				}
-				cont = true
-			} else {
-				if frame.opcode != OpCodeCONT {
-					return nil, ErrUnexpectedOpCode
-				}
-			}
-			framePayload := make([]byte, frame.payloadLen)
-			var framePayloadSize int
-			for framePayloadSize < len(framePayload) {
-				n, err := ws.readFramePayloadChunk(frame, framePayload, framePayloadSize)
-				if err != nil {
-					return nil, err
-				}
-				payload = append(payload, framePayload[framePayloadSize:framePayloadSize+n]...)
-				framePayloadSize += n
-				if message.Kind == MessageTEXT {
-					// Verifying UTF-8
-					for verifyPos < len(payload) {
-						size := len(payload) - verifyPos
-						if _, err := utf8ToChar32Fixed(payload[verifyPos:], &size); err != nil {
-							if errors.Is(err, ErrShortUtf8) {
-								if !frame.fin {
-									savedLen := len(payload)
-									extendUnfinishedUtf8(&payload, verifyPos)
-									size = len(payload) - verifyPos
-									_, err := utf8ToChar32Fixed(payload[verifyPos:], &size)
-									if err != nil {
-										return nil, err
-									}
-									payload = payload[:savedLen]
-									break // Tolerating the unfinished UTF-8 sequences if the message is unfinished
-								}
-								return nil, err
-							} else {
-								return nil, err
-							}
-						}
-						verifyPos += size
-					}
-
-				}
-			}
-			if frame.fin {
-				break
-			}
-		}
-
-	}
-	message.Payload = payload
-	return &message, nil
+	kind, r, err := ws.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	buffer := readBufferPool.Get().(*bytes.Buffer)
+	defer func() {
+		// A single huge message must not stay in memory for good
+		if buffer.Cap() <= maxPooledReadBuffer {
+			readBufferPool.Put(buffer)
+		}
+	}()
+	buffer.Reset()
+	if _, err := buffer.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, buffer.Len())
+	copy(payload, buffer.Bytes())
+	return &WSMessage{Kind: kind, Payload: payload}, nil
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////////////////
 ////////////////////////////////////////////////////////////////////////////////////////////////////////
 
+// Dial Errors
+var ErrDialBadScheme = errors.New("dial bad scheme")
+var ErrDialBadURL = errors.New("dial bad url")
+var ErrDialNoAddress = errors.New("dial no address")
+
+// Server Errors
+var ErrServerClosed = errors.New("server closed")
+var ErrServerListening = errors.New("server already listening")
+var ErrServerNotListening = errors.New("server not listening")
+var ErrServerBadNetwork = errors.New("server bad network")
+var ErrServerBadAddress = errors.New("server bad address")
+
+// TLS Errors
+var ErrTLSUnsupportedTransport = errors.New("tls unsupported transport")
+var ErrTLSKeyNotPinned = errors.New("tls key not pinned")
+
 // Client Handshake Errors
 var ErrClientHandshakeBadResponse = errors.New("client handshake bad response")
 var ErrClientHandshakeNoAccept = errors.New("client handshake no accept")
 var ErrClientHandshakeDuplicateAccept = errors.New("client handshake duplicate accept")
 var ErrClientHandshakeBadAccept = errors.New("client handshake bad accept")
+var ErrClientHandshakeNoUpgrade = errors.New("client handshake no upgrade")
+var ErrClientHandshakeNoConnection = errors.New("client handshake no connection upgrade")
+var ErrClientHandshakeBadSubprotocol = errors.New("client handshake bad subprotocol")
+var ErrClientHandshakeBadExtension = errors.New("client handshake bad extension")
 
 // Server Handshake Errors
 var ErrServerHandshakeBadRequest = errors.New("server handshake bad request")
 var ErrServerHandshakeNoKey = errors.New("server handshake no key")
 var ErrServerHandshakeDuplicateKey = errors.New("server handshake duplicate key")
+var ErrServerHandshakeBadKey = errors.New("server handshake bad key")
+var ErrServerHandshakeBadMethod = errors.New("server handshake bad method")
+var ErrServerHandshakeBadProto = errors.New("server handshake bad protocol version")
+var ErrServerHandshakeNoHost = errors.New("server handshake no host")
+var ErrServerHandshakeNoUpgrade = errors.New("server handshake no upgrade")
+var ErrServerHandshakeNoConnection = errors.New("server handshake no connection upgrade")
+var ErrServerHandshakeBadVersion = errors.New("server handshake bad websocket version")
+var ErrServerHandshakeBadOrigin = errors.New("server handshake bad origin")
+
+// Extension Errors
+var ErrBadExtensions = errors.New("bad extensions header")
+var ErrDeflateBadTail = errors.New("deflate bad tail")
+
+// HTTP Errors
+var ErrHTTPBadStartLine = errors.New("http bad start line")
+var ErrHTTPBadHeader = errors.New("http bad header")
+var ErrHeaderTooLarge = errors.New("http header too large")
+var ErrUpgradeNotHijackable = errors.New("http response writer not hijackable")
 
 // Connection Errors
 var ErrCloseFrameSent = errors.New("close frame sent")
+var ErrCloseSent = errors.New("close already sent")
+var ErrBadClosePayload = errors.New("bad close payload")
+var ErrBadCloseCode = errors.New("bad close code")
+var ErrCloseReasonTooLong = errors.New("close reason too long")
 var ErrControlFrameTooBig = errors.New("control frame too big")
+var ErrBadPayloadLength = errors.New("bad payload length")
+var ErrFrameTooBig = errors.New("frame too big")
+var ErrMessageTooBig = errors.New("message too big")
 var ErrReservedBitsNotNegotiated = errors.New("reserved bits not negotiated")
 var ErrUnexpectedOpCode = errors.New("unexpected opcode")
+var ErrWriterClosed = errors.New("message writer closed")
+var ErrBadMessageKind = errors.New("bad message kind")
+var ErrPongTimeout = errors.New("pong timeout")
+var ErrMaskedServerFrame = errors.New("masked server frame")
+var ErrUnmaskedClientFrame = errors.New("unmasked client frame")
 
 // utf-8 Errors
 var ErrShortUtf8 = errors.New("short utf-8")
@@ -562,107 +780,131 @@ func headerMacro(header []byte, field string) byte {
 	}
 }
 
+// RFC 6455 - Section 4.1:
+// > The request MUST include a header field with the name
+// > |Sec-WebSocket-Key|.  The value of this header field MUST be a
+// > nonce consisting of a randomly selected 16-byte value that has
+// > been base64-encoded (see Section 4 of [RFC4648]).  The nonce
+// > MUST be selected randomly for each connection.
+func generateSecWebSocketKey() (string, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(nonce[:]), nil
+}
+
 func computeSecWebSocketAccept(secWebSocketKey string) string {
 	h := sha1.New()
 	io.WriteString(h, secWebSocketKey+"258EAFA5-E914-47DA-95CA-C5AB0DC85B11")
 	return base64.StdEncoding.EncodeToString(h.Sum(nil))
 }
 
-func parseSecWebSocketKeyFromRequest(request *string) (string, error) {
-	foundSecWebSocketKey := false
-	var secWebSocketKey string
-	const lineSep = "\r\n"
-	const headerSep = ":"
-
-	// TODO: verify the request status line
-	if index := strings.Index(*request, lineSep); index != -1 {
-		*request = (*request)[index+len(lineSep):]
-	} else {
-		return "", ErrServerHandshakeBadRequest
-	}
-	// TODO: verify the rest of the headers of the request
-	// Right now we are only looking for Sec-WebSocket-Key
-	for len(*request) > 0 && !strings.HasPrefix(*request, lineSep) {
-		var header string
-		if index := strings.Index(*request, lineSep); index != -1 {
-			header = (*request)[0:index]
-			*request = (*request)[index+len(lineSep):]
-		} else {
-			return "", ErrServerHandshakeBadRequest
-		}
-		var key, value string
-		if index := strings.Index(header, headerSep); index != -1 {
-			key = strings.TrimSpace(header[0:index])
-			value = strings.TrimSpace(header[index+len(headerSep):])
-		} else {
-			return "", ErrServerHandshakeBadRequest
-		}
-		if key == "Sec-WebSocket-Key" {
-			if foundSecWebSocketKey {
-				return "", ErrServerHandshakeDuplicateKey
-			}
-			secWebSocketKey = value
-			foundSecWebSocketKey = true
-		}
-
+// RFC 6455 - Section 4.2.1:
+// > The client's opening handshake consists of the following parts. ...
+func verifyUpgradeRequest(request *WSRequest) (string, error) {
+	// > 1.   An HTTP/1.1 or higher GET request, including a "Request-URI"
+	if request.Method != "GET" {
+		return "", ErrServerHandshakeBadMethod
+	}
+	if request.ProtoMajor < 1 || (request.ProtoMajor == 1 && request.ProtoMinor < 1) {
+		return "", ErrServerHandshakeBadProto
+	}
+	// > 2.   A |Host| header field containing the server's authority.
+	if len(request.Header.Values("Host")) != 1 {
+		return "", ErrServerHandshakeNoHost
+	}
+	// > 3.   An |Upgrade| header field containing the value "websocket",
+	// >      treated as an ASCII case-insensitive value.
+	if !headerContainsToken(request.Header, "Upgrade", "websocket") {
+		return "", ErrServerHandshakeNoUpgrade
+	}
+	// > 4.   A |Connection| header field that includes the token "Upgrade",
+	// >      treated as an ASCII case-insensitive value.
+	if !headerContainsToken(request.Header, "Connection", "Upgrade") {
+		return "", ErrServerHandshakeNoConnection
+	}
+	// > 5.   A |Sec-WebSocket-Key| header field with a base64-encoded (see
+	// >      Section 4 of [RFC4648]) value that, when decoded, is 16 bytes in
+	// >      length.
+	keys := request.Header.Values("Sec-WebSocket-Key")
+	if len(keys) == 0 {
+		return "", ErrServerHandshakeNoKey
 	}
-	if !strings.HasPrefix(*request, lineSep) {
-		return "", ErrServerHandshakeBadRequest
+	if len(keys) > 1 {
+		return "", ErrServerHandshakeDuplicateKey
 	}
-	*request = (*request)[len(lineSep):]
-	if !foundSecWebSocketKey {
-		return "", ErrServerHandshakeNoKey
+	if nonce, err := base64.StdEncoding.DecodeString(keys[0]); err != nil || len(nonce) != 16 {
+		return "", ErrServerHandshakeBadKey
 	}
-	return secWebSocketKey, nil
+	// > 6.   A |Sec-WebSocket-Version| header field, with a value of 13.
+	if versions := request.Header.Values("Sec-WebSocket-Version"); len(versions) != 1 || versions[0] != "13" {
+		return "", ErrServerHandshakeBadVersion
+	}
+	return keys[0], nil
 }
 
-func parseSecWebSocketAcceptFromResponse(response *string) (string, error) {
-	foundSecWebSocketAccept := false
-	var secWebSocketAccept string
-	const lineSep = "\r\n"
-	const headerSep = ":"
-
-	// TODO: verify the response status line
-	//   If the status code is an error one, log the message
-	if index := strings.Index(*response, lineSep); index != -1 {
-		*response = (*response)[index+len(lineSep):]
-	} else {
-		return "", ErrClientHandshakeBadResponse
-	}
-	// TODO: verify the rest of the headers of the response
-	// Right now we are only looking for Sec-WebSocket-Accept
-	for len(*response) > 0 && !strings.HasPrefix(*response, lineSep) {
-		var header string
-		if index := strings.Index(*response, lineSep); index != -1 {
-			header = (*response)[0:index]
-			*response = (*response)[index+len(lineSep):]
-		} else {
-			return "", ErrClientHandshakeBadResponse
-		}
-		var key, value string
-		if index := strings.Index(header, headerSep); index != -1 {
-			key = strings.TrimSpace(header[0:index])
-			value = strings.TrimSpace(header[index+len(headerSep):])
-		} else {
-			return "", ErrClientHandshakeBadResponse
-		}
-		if key == "Sec-WebSocket-Accept" {
-			if foundSecWebSocketAccept {
-				return "", ErrClientHandshakeDuplicateAccept
-			}
-			secWebSocketAccept = value
-			foundSecWebSocketAccept = true
+// RFC 6455 - Section 4.2.2:
+// > |Sec-WebSocket-Protocol|
+// >    If the server does not wish to agree to one of the suggested
+// >    subprotocols, it MUST NOT send back a |Sec-WebSocket-Protocol|
+// >    header field in its response.
+func selectSubprotocol(request *WSRequest, opts *AcceptOptions) string {
+	offered := headerTokens(request.Header, "Sec-WebSocket-Protocol")
+	if len(offered) == 0 {
+		return ""
+	}
+	if opts.SelectSubprotocol != nil {
+		selected := opts.SelectSubprotocol(request, offered)
+		// The server is not allowed to select something the client has never asked for
+		if !slices.Contains(offered, selected) {
+			return ""
 		}
-
+		return selected
 	}
-	if !strings.HasPrefix(*response, lineSep) {
-		return "", ErrClientHandshakeBadResponse
+	for _, protocol := range opts.Subprotocols {
+		if slices.Contains(offered, protocol) {
+			return protocol
+		}
 	}
-	*response = (*response)[len(lineSep):]
-	if !foundSecWebSocketAccept {
-		return "", ErrClientHandshakeNoAccept
+	return ""
+}
+
+// RFC 6455 - Section 4.1:
+// > The client MUST validate the server's response as follows: ...
+func verifyUpgradeResponse(header http.Header, secWebSocketKey string) error {
+	// > 2. If the response lacks an |Upgrade| header field or the |Upgrade|
+	// >    header field contains a value that is not an ASCII case-
+	// >    insensitive match for the value "websocket", the client MUST
+	// >    _Fail the WebSocket Connection_.
+	if upgrades := header.Values("Upgrade"); len(upgrades) != 1 || !strings.EqualFold(strings.TrimSpace(upgrades[0]), "websocket") {
+		return ErrClientHandshakeNoUpgrade
+	}
+	// > 3. If the response lacks a |Connection| header field or the
+	// >    |Connection| header field doesn't contain a token that is an
+	// >    ASCII case-insensitive match for the value "Upgrade", the client
+	// >    MUST _Fail the WebSocket Connection_.
+	if !headerContainsToken(header, "Connection", "Upgrade") {
+		return ErrClientHandshakeNoConnection
+	}
+	// > 4. If the response lacks a |Sec-WebSocket-Accept| header field or
+	// >    the |Sec-WebSocket-Accept| contains a value other than the
+	// >    base64-encoded SHA-1 of the concatenation of the |Sec-WebSocket-
+	// >    Key| (as a string, not base64-decoded) with the string "258EAFA5-
+	// >    E914-47DA-95CA-C5AB0DC85B11" but ignoring any leading and
+	// >    trailing whitespace, the client MUST _Fail the WebSocket
+	// >    Connection_.
+	accepts := header.Values("Sec-WebSocket-Accept")
+	if len(accepts) == 0 {
+		return ErrClientHandshakeNoAccept
+	}
+	if len(accepts) > 1 {
+		return ErrClientHandshakeDuplicateAccept
+	}
+	if accepts[0] != computeSecWebSocketAccept(secWebSocketKey) {
+		return ErrClientHandshakeBadAccept
 	}
-	return secWebSocketAccept, nil
+	return nil
 }
 
 type WSMessageKind byte
@@ -724,6 +966,10 @@ type WSFrameHeader struct {
 	mask                  [4]byte
 }
 
+func (frameHeader WSFrameHeader) rsv() byte {
+	return byte(btoi(frameHeader.rsv1))<<6 | byte(btoi(frameHeader.rsv2))<<5 | byte(btoi(frameHeader.rsv3))<<4
+}
+
 func btoi(b bool) int {
 	if b {
 		return 1
@@ -734,118 +980,3 @@ func btoi(b bool) int {
 func itob(i uint8) bool {
 	return i != 0
 }
-
-func extendUnfinishedUtf8(payload *[]byte, pos int) {
-	c := (*payload)[pos]
-	var size int
-	if c&0x80 == 0 {
-		size = 1
-	} else if c&0xE0 == 0xC0 {
-		size = 2
-	} else if c&0xF0 == 0xE0 {
-		size = 3
-	} else {
-		size = 4
-	}
-	for len(*payload)-pos < size {
-		*payload = append(*payload, 0b1000_0000)
-	}
-}
-
-func utf8ToChar32Fixed(payload []byte, size *int) (rune, error) {
-	maxSize := *size
-	if maxSize < 1 {
-		return 0, ErrShortUtf8
-	}
-	c := payload[0]
-	if c&0x80 == 0 {
-		*size = 1
-		return rune(c), nil
-	}
-	if c&0xE0 == 0xC0 {
-		if maxSize < 2 {
-			return 0, ErrShortUtf8
-		}
-		*size = 2
-		uc := rune(c&0x1F) << 6
-		c = payload[1]
-		// Overlong sequence or invalid second.
-		if uc == 0 || c&0xC0 != 0x80 {
-			return 0, ErrInvalidUtf8
-		}
-		uc += rune(c & 0x3F)
-		// NEW: maximum overlong sequence
-		if uc <= 0b111_1111 {
-			return 0, ErrInvalidUtf8
-		}
-		// NEW: UTF-16 surrogate pairs
-		if 0xD800 <= uc && uc <= 0xDFFF {
-			return 0, ErrInvalidUtf8
-		}
-		return uc, nil
-	}
-	if c&0xF0 == 0xE0 {
-		if maxSize < 3 {
-			return 0, ErrShortUtf8
-		}
-		*size = 3
-		uc := rune(c&0x0F) << 12
-		c = payload[1]
-		// Overlong sequence or invalid last.
-		if c&0xC0 != 0x80 {
-			return 0, ErrInvalidUtf8
-		}
-		uc += rune(c&0x3F) << 6
-		c = payload[2]
-		if uc == 0 || c&0xC0 != 0x80 {
-			return 0, ErrInvalidUtf8
-		}
-		uc += rune(c & 0x3F)
-		// NEW: maximum overlong sequence
-		if uc <= 0b11111_111111 {
-			return 0, ErrInvalidUtf8
-		}
-		// NEW: UTF-16 surrogate pairs
-		if 0xD800 <= uc && uc <= 0xDFFF {
-			return 0, ErrInvalidUtf8
-		}
-		return uc, nil
-	}
-	if c&0xF0 == 0xF0 {
-		if maxSize < 4 {
-			return 0, ErrShortUtf8
-		}
-		if c&0xF8 != 0xF0 {
-			return 0, ErrInvalidUtf8
-		}
-		*size = 4
-		uc := rune(c&0x07) << 18
-		c = payload[1]
-		if c&0xC0 != 0x80 {
-			return 0, ErrInvalidUtf8
-		}
-		uc += rune(c&0x3F) << 12
-		c = payload[2]
-		if c&0xC0 != 0x80 {
-			return 0, ErrInvalidUtf8
-		}
-		uc += rune(c&0x3F) << 6
-		c = payload[3]
-		if uc == 0 || c&0xC0 != 0x80 {
-			return 0, ErrInvalidUtf8
-		}
-		uc += rune(c & 0x3F)
-		// NEW: UTF-16 surrogate pairs
-		if 0xD800 <= uc && uc <= 0xDFFF {
-			return 0, ErrInvalidUtf8
-		}
-		if uc <= 0b1111_111111_111111 {
-			return 0, ErrInvalidUtf8
-		}
-		if uc > 0x10FFFF {
-			return 0, ErrInvalidUtf8
-		}
-		return uc, nil
-	}
-	return 0, ErrInvalidUtf8
-}